@@ -1,27 +1,27 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
+	"time"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+const retryDelay = time.Second
+
 func handlerPause(gs *gamelogic.GameState) func(routing.PlayingState) pubsub.AckType {
 	return func(ps routing.PlayingState) pubsub.AckType {
-		defer fmt.Print("> ")
-
 		gs.HandlePause(ps)
 		return pubsub.Ack
 	}
 }
 
-func handlerMove(gs *gamelogic.GameState, publishCh *amqp.Channel) func(gamelogic.ArmyMove) pubsub.AckType {
-	return func(move gamelogic.ArmyMove) pubsub.AckType {
-		defer fmt.Print("> ")
-
+func handlerMove(gs *gamelogic.GameState, outbox *pubsub.Outbox, topicExchange string) func(gamelogic.ArmyMove, pubsub.Metadata) pubsub.AckType {
+	return func(move gamelogic.ArmyMove, meta pubsub.Metadata) pubsub.AckType {
 		moveOutcome := gs.HandleMove(move)
 		switch moveOutcome {
 		case gamelogic.MoveOutComeSafe:
@@ -29,30 +29,43 @@ func handlerMove(gs *gamelogic.GameState, publishCh *amqp.Channel) func(gamelogi
 		case gamelogic.MoveOutcomeSamePlayer:
 			return pubsub.Ack
 		case gamelogic.MoveOutcomeMakeWar:
-			if err := pubsub.PublishJSON(
-				publishCh,
-				routing.ExchangePerilTopic,
+			err := pubsub.Enqueue(
+				meta.Context(),
+				outbox,
+				topicExchange,
 				routing.WarRecognitionsPrefix+"."+gs.GetUsername(),
 				gamelogic.RecognitionOfWar{
 					Attacker: move.Player,
 					Defender: gs.GetPlayerSnap(),
 				},
-			); err != nil {
-				fmt.Printf("error: %v\n", err)
-				return pubsub.NackRequeue
+				pubsub.WithCodec(pubsub.JSON),
+				pubsub.WithMandatory(),
+				pubsub.WithPublisher(gs.GetUsername()),
+				// Lets the war be traced back to the move that started it
+				pubsub.WithCorrelationID(meta.MessageID),
+			)
+			if err != nil {
+				slog.Error("couldn't save war declaration for publishing",
+					"username", gs.GetUsername(),
+					"message_id", meta.MessageID,
+					"err", err,
+				)
+				return pubsub.RetryAfter(retryDelay)
 			}
 			return pubsub.Ack
 		default:
-			fmt.Println("error: unknown move outcome")
+			slog.Error("unknown move outcome",
+				"username", gs.GetUsername(),
+				"message_id", meta.MessageID,
+				"outcome", moveOutcome,
+			)
 			return pubsub.NackDiscard
 		}
 	}
 }
 
-func handlerWar(gs *gamelogic.GameState, publishCh *amqp.Channel) func(gamelogic.RecognitionOfWar) pubsub.AckType {
-	return func(rw gamelogic.RecognitionOfWar) pubsub.AckType {
-		defer fmt.Print("> ")
-
+func handlerWar(gs *gamelogic.GameState, gameLogs gameLogPublisher) func(gamelogic.RecognitionOfWar, pubsub.Metadata) pubsub.AckType {
+	return func(rw gamelogic.RecognitionOfWar, meta pubsub.Metadata) pubsub.AckType {
 		var message string
 		warOutcome, winner, loser := gs.HandleWar(rw)
 		switch warOutcome {
@@ -67,18 +80,35 @@ func handlerWar(gs *gamelogic.GameState, publishCh *amqp.Channel) func(gamelogic
 		case gamelogic.WarOutcomeDraw:
 			message = fmt.Sprintf("A war between %s and %s resulted in a draw", winner, loser)
 		default:
-			fmt.Println("error: unknown war outcome")
+			slog.Error("unknown war outcome",
+				"username", gs.GetUsername(),
+				"message_id", meta.MessageID,
+				"outcome", warOutcome,
+			)
 			return pubsub.NackDiscard
 		}
 
-		// Publish game log whenever a war happens
-		if err := publishGameLog(
-			publishCh,
-			gs.GetUsername(),
+		if meta.CorrelationID != "" {
+			message += fmt.Sprintf(" (started by move %s)", meta.CorrelationID)
+		}
+
+		// Record a game log whenever a war happens
+		err := gameLogs.enqueue(
+			meta.Context(),
 			message,
-		); err != nil {
-			fmt.Printf("error: %v\n", err)
-			return pubsub.NackRequeue
+			pubsub.WithCorrelationID(meta.CorrelationID),
+		)
+		if errors.Is(err, pubsub.ErrRateLimited) {
+			// Fighting the war again wouldn't get the log under the limit
+			return pubsub.Ack
+		}
+		if err != nil {
+			slog.Error("couldn't save game log for publishing",
+				"username", gs.GetUsername(),
+				"message_id", meta.MessageID,
+				"err", err,
+			)
+			return pubsub.RetryAfter(retryDelay)
 		}
 		return pubsub.Ack
 	}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+type dlqBroker interface {
+	pubsub.Publisher
+	pubsub.Inspector
+}
+
+const dlqUsage = "usage: dlq list | dlq show <n> | dlq replay <n|all> | dlq purge"
+
+// commandDLQ runs the dlq commands against the dead letter queue. Messages
+// are numbered from 1 in queue order, as dlq list shows them.
+func commandDLQ(ctx context.Context, broker dlqBroker, queue string, words []string) {
+	if len(words) < 2 {
+		fmt.Println(dlqUsage)
+		return
+	}
+	switch words[1] {
+	case "list":
+		dlqList(broker, queue)
+	case "show":
+		n, ok := dlqPosition(words)
+		if !ok {
+			return
+		}
+		dlqShow(broker, queue, n)
+	case "replay":
+		if len(words) == 3 && words[2] == "all" {
+			dlqReplay(ctx, broker, queue, 0)
+			return
+		}
+		n, ok := dlqPosition(words)
+		if !ok {
+			return
+		}
+		dlqReplay(ctx, broker, queue, n)
+	case "purge":
+		n, err := broker.Purge(queue)
+		if err != nil {
+			fmt.Printf("Couldn't purge dead letters: %v\n", err)
+			return
+		}
+		fmt.Printf("Purged %d dead letters\n", n)
+	default:
+		fmt.Println(dlqUsage)
+	}
+}
+
+func dlqPosition(words []string) (int, bool) {
+	if len(words) != 3 {
+		fmt.Println(dlqUsage)
+		return 0, false
+	}
+	n, err := strconv.Atoi(words[2])
+	if err != nil || n < 1 {
+		fmt.Printf("error: %s is not a message number\n", words[2])
+		return 0, false
+	}
+	return n, true
+}
+
+func dlqList(broker dlqBroker, queue string) {
+	count := 0
+	err := broker.Inspect(queue, 0, func(i int, d pubsub.Delivery) bool {
+		count++
+		fmt.Printf("%d. %s\n", i+1, dlqSummary(d))
+		return false
+	})
+	if err != nil {
+		fmt.Printf("Couldn't list dead letters: %v\n", err)
+		return
+	}
+	if count == 0 {
+		fmt.Println("No dead letters")
+	}
+}
+
+func dlqShow(broker dlqBroker, queue string, n int) {
+	found := false
+	err := broker.Inspect(queue, n, func(i int, d pubsub.Delivery) bool {
+		if i == n-1 {
+			found = true
+			printDeadLetter(d)
+		}
+		return false
+	})
+	if err != nil {
+		fmt.Printf("Couldn't read dead letters: %v\n", err)
+		return
+	}
+	if !found {
+		fmt.Printf("There is no dead letter %d\n", n)
+	}
+}
+
+// dlqReplay republishes dead letter n of queue, or every one if n is 0.
+// Messages that can't be replayed stay in the queue.
+func dlqReplay(ctx context.Context, broker dlqBroker, queue string, n int) {
+	replayed, failed := 0, 0
+	err := broker.Inspect(queue, n, func(i int, d pubsub.Delivery) bool {
+		if n != 0 && i != n-1 {
+			return false
+		}
+		if err := pubsub.Replay(ctx, broker, d); err != nil {
+			fmt.Printf("Couldn't replay dead letter %d: %v\n", i+1, err)
+			failed++
+			return false
+		}
+		replayed++
+		return true
+	})
+	if err != nil {
+		fmt.Printf("Couldn't read dead letters: %v\n", err)
+		return
+	}
+	if replayed == 0 && failed == 0 {
+		if n == 0 {
+			fmt.Println("No dead letters")
+		} else {
+			fmt.Printf("There is no dead letter %d\n", n)
+		}
+		return
+	}
+	fmt.Printf("Replayed %d dead letters\n", replayed)
+}
+
+func dlqSummary(d pubsub.Delivery) string {
+	var b strings.Builder
+	if exchange, key, ok := pubsub.DeadLetterOrigin(d); ok {
+		fmt.Fprintf(&b, "%s via %s", key, exchangeName(exchange))
+	} else {
+		fmt.Fprintf(&b, "%s via %s", d.RoutingKey, exchangeName(d.Exchange))
+	}
+	if deaths := pubsub.Deaths(d.Headers); len(deaths) > 0 {
+		fmt.Fprintf(&b, ": %s from %s", deaths[0].Reason, deaths[0].Queue)
+		if deaths[0].Count > 1 {
+			fmt.Fprintf(&b, " (%d times)", deaths[0].Count)
+		}
+	} else if _, ok := d.Headers[pubsub.HeaderDecodeError]; ok {
+		queue, _ := d.Headers[pubsub.HeaderOriginalQueue].(string)
+		fmt.Fprintf(&b, ": undecodable in %s", queue)
+	}
+	fmt.Fprintf(&b, ", %s, %d bytes", contentType(d), len(d.Body))
+	if d.MessageID != "" {
+		fmt.Fprintf(&b, ", id %s", d.MessageID)
+	}
+	return b.String()
+}
+
+func printDeadLetter(d pubsub.Delivery) {
+	fmt.Printf("Message ID:   %s\n", d.MessageID)
+	if !d.Timestamp.IsZero() {
+		fmt.Printf("Published:    %s\n", d.Timestamp.Format(time.RFC3339))
+	}
+	if publisher, ok := d.Headers[pubsub.HeaderPublisher].(string); ok {
+		fmt.Printf("Publisher:    %s\n", publisher)
+	}
+	fmt.Printf("Content-Type: %s\n", contentType(d))
+	exchange, key, ok := pubsub.DeadLetterOrigin(d)
+	if ok {
+		fmt.Printf("Origin:       %s via %s\n", key, exchangeName(exchange))
+	}
+	for _, death := range pubsub.Deaths(d.Headers) {
+		fmt.Printf("Died:         %s from %s at %s (count %d)\n",
+			death.Reason, death.Queue, death.Time.Format(time.RFC3339), death.Count)
+	}
+	if reason, ok := d.Headers[pubsub.HeaderDecodeError].(string); ok {
+		queue, _ := d.Headers[pubsub.HeaderOriginalQueue].(string)
+		fmt.Printf("Died:         couldn't be decoded in %s: %s\n", queue, reason)
+	}
+
+	var names []string
+	for name := range d.Headers {
+		if !strings.HasPrefix(name, "x-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("Header:       %s=%v\n", name, d.Headers[name])
+	}
+
+	body, err := decodeDeadLetter(d, key)
+	if err != nil {
+		fmt.Printf("Body:         couldn't decode: %v\n", err)
+		fmt.Printf("Raw body:     %q\n", d.Body)
+		return
+	}
+	fmt.Printf("Body:         %+v\n", body)
+}
+
+// decodeDeadLetter decodes the body with the codec its Content-Type names,
+// into the type published with key.
+func decodeDeadLetter(d pubsub.Delivery, key string) (any, error) {
+	codec, ok := pubsub.DefaultCodecs.Lookup(d.ContentType)
+	if !ok {
+		return nil, fmt.Errorf("no codec for content type %q", d.ContentType)
+	}
+
+	var v any
+	switch {
+	case strings.HasPrefix(key, routing.GameLogSlug+"."):
+		v = &routing.GameLog{}
+	case strings.HasPrefix(key, routing.ArmyMovesPrefix+"."):
+		v = &gamelogic.ArmyMove{}
+	case strings.HasPrefix(key, routing.WarRecognitionsPrefix+"."):
+		v = &gamelogic.RecognitionOfWar{}
+	case key == routing.PauseKey:
+		v = &routing.PlayingState{}
+	default:
+		var anything any
+		v = &anything
+	}
+	if err := codec.Unmarshal(d.Body, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func contentType(d pubsub.Delivery) string {
+	if d.ContentType == "" {
+		return "no content type"
+	}
+	return d.ContentType
+}
+
+func exchangeName(exchange string) string {
+	if exchange == "" {
+		return "the default exchange"
+	}
+	return exchange
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/topology"
+)
+
+func TestDLQUsesConfiguredQueue(t *testing.T) {
+	b := pubsub.NewMemoryBroker()
+	b.SetMetrics(nil)
+	defer b.Close()
+	o := topology.DefaultPerilOptions()
+	o.DeadLetterQueue = "custom_dlq"
+	if err := topology.PerilWith(o).Apply(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeclareQueue(routing.DeadLetterQueue, pubsub.SimpleQueueDurable, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, queue := range []string{"custom_dlq", routing.DeadLetterQueue} {
+		if err := b.Publish(context.Background(), "", queue, pubsub.Message{Body: []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commandDLQ(context.Background(), b, "custom_dlq", []string{"dlq", "purge"})
+
+	for queue, want := range map[string]int{"custom_dlq": 0, routing.DeadLetterQueue: 1} {
+		n := 0
+		if err := b.Inspect(queue, 0, func(int, pubsub.Delivery) bool { n++; return false }); err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("%s holds %d messages, want %d", queue, n, want)
+		}
+	}
+}
@@ -1,20 +1,46 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
+	"time"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 )
 
-func handlerGameLog() func(gamelog routing.GameLog) pubsub.AckType {
-	return func(gamelog routing.GameLog) pubsub.AckType {
-		defer fmt.Print("> ")
+const retryDelay = time.Second
 
-		if err := gamelogic.WriteLog(gamelog); err != nil {
-			fmt.Printf("error writing log: %v\n", err)
-			return pubsub.NackRequeue
+// authorizeGameLog stops players from writing logs under someone else's
+// name: a log must say who published it, and be published by the player it
+// is about under their own key.
+var authorizeGameLog = pubsub.Authorize(func(d pubsub.Delivery) error {
+	publisher, ok := d.Headers[pubsub.HeaderPublisher].(string)
+	if !ok || publisher == "" {
+		return errors.New("game log doesn't say who published it")
+	}
+	if d.RoutingKey != routing.GameLogSlug+"."+publisher {
+		return fmt.Errorf("%s can't publish to %s", publisher, d.RoutingKey)
+	}
+	if username := gameLogUsername(d); username != publisher {
+		return fmt.Errorf("%s can't publish a game log for %q", publisher, username)
+	}
+	return nil
+})
+
+// gameLogUsername keys the game log rate limit. Logs predating CBOR have no
+// content type and are gob.
+var gameLogUsername = pubsub.BodyKey(pubsub.Gob, func(gamelog routing.GameLog) string {
+	return gamelog.Username
+})
+
+func handlerGameLog(path string) func(gamelog routing.GameLog) pubsub.AckType {
+	return func(gamelog routing.GameLog) pubsub.AckType {
+		if err := gamelogic.WriteLogTo(path, gamelog); err != nil {
+			slog.Error("couldn't write game log", "username", gamelog.Username, "err", err)
+			return pubsub.RetryAfter(retryDelay)
 		}
 		return pubsub.Ack
 	}
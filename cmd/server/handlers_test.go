@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestAuthorizeGameLog(t *testing.T) {
+	gameLog := func(username, publisher, key string) pubsub.Delivery {
+		body, err := pubsub.CBOR.Marshal(routing.GameLog{Username: username, Message: "won a war"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := pubsub.Delivery{
+			Message:    pubsub.Message{ContentType: pubsub.CBOR.ContentType(), Body: body},
+			RoutingKey: key,
+		}
+		if publisher != "" {
+			d.Headers = map[string]any{pubsub.HeaderPublisher: publisher}
+		}
+		return d
+	}
+	tests := []struct {
+		name string
+		d    pubsub.Delivery
+		want pubsub.AckType
+	}{
+		{"own log", gameLog("washington", "washington", "game_logs.washington"), pubsub.Ack},
+		{"no publisher", gameLog("washington", "", "game_logs.washington"), pubsub.NackDiscard},
+		{"someone else's key", gameLog("lee", "washington", "game_logs.lee"), pubsub.NackDiscard},
+		{"someone else's name", gameLog("lee", "washington", "game_logs.washington"), pubsub.NackDiscard},
+		{"undecodable", pubsub.Delivery{
+			RoutingKey: "game_logs.washington",
+			Message:    pubsub.Message{ContentType: pubsub.CBOR.ContentType(), Headers: map[string]any{pubsub.HeaderPublisher: "washington"}},
+		}, pubsub.NackDiscard},
+	}
+	handler := authorizeGameLog(func(pubsub.Delivery) pubsub.AckType { return pubsub.Ack })
+	for _, tt := range tests {
+		if got := handler(tt.d); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
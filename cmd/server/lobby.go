@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// lobbyPlayerTTL is how long a player stays in the lobby without joining or
+// spawning again. Players who quit leave straight away.
+const lobbyPlayerTTL = 24 * time.Hour
+
+// lobby is who has joined the game and whether it is paused. It is kept in
+// a file, so a server that restarts, or takes over the lobby queue from
+// another sharing the file, carries on where the last one left off.
+type lobby struct {
+	mu    sync.Mutex
+	path  string
+	state lobbyState
+	// stamp is the file as this server last read or wrote it; any other
+	// stamp means another server has written it since
+	stamp lobbyStamp
+}
+
+type lobbyState struct {
+	// Players maps each player to when they were last seen
+	Players map[string]time.Time `json:"players"`
+	Paused  bool                 `json:"paused"`
+}
+
+func (s lobbyState) clone() lobbyState {
+	players := make(map[string]time.Time, len(s.Players))
+	for player, seen := range s.Players {
+		players[player] = seen
+	}
+	return lobbyState{Players: players, Paused: s.Paused}
+}
+
+type lobbyStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func openLobby(path string) (*lobby, error) {
+	l := &lobby{path: path}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *lobby) load() error {
+	state := lobbyState{Players: map[string]time.Time{}}
+	data, err := os.ReadFile(l.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("couldn't read lobby: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("couldn't decode lobby: %w", err)
+		}
+		if state.Players == nil {
+			state.Players = map[string]time.Time{}
+		}
+	}
+	stamp, err := l.stat()
+	if err != nil {
+		return err
+	}
+	l.state, l.stamp = state, stamp
+	return nil
+}
+
+func (l *lobby) stat() (lobbyStamp, error) {
+	info, err := os.Stat(l.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return lobbyStamp{}, nil
+	}
+	if err != nil {
+		return lobbyStamp{}, fmt.Errorf("couldn't read lobby: %w", err)
+	}
+	return lobbyStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// syncLocked reloads the lobby if another server has written it since.
+func (l *lobby) syncLocked() error {
+	stamp, err := l.stat()
+	if err != nil {
+		return err
+	}
+	if stamp == l.stamp {
+		return nil
+	}
+	return l.load()
+}
+
+// saveLocked writes the lobby to a new file that only replaces the old one
+// once it is complete.
+func (l *lobby) saveLocked() error {
+	data, err := json.Marshal(l.state)
+	if err != nil {
+		return fmt.Errorf("couldn't encode lobby: %w", err)
+	}
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("couldn't save lobby: %w", err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return fmt.Errorf("couldn't save lobby: %w", err)
+	}
+	l.stamp, err = l.stat()
+	return err
+}
+
+// expireLocked drops players who haven't been seen for lobbyPlayerTTL and
+// reports whether there were any.
+func (l *lobby) expireLocked(now time.Time) bool {
+	expired := false
+	for player, seen := range l.state.Players {
+		if now.Sub(seen) >= lobbyPlayerTTL {
+			slog.Info("player expired", "username", player)
+			delete(l.state.Players, player)
+			expired = true
+		}
+	}
+	return expired
+}
+
+func (l *lobby) playersLocked() []string {
+	players := make([]string, 0, len(l.state.Players))
+	for player := range l.state.Players {
+		players = append(players, player)
+	}
+	sort.Strings(players)
+	return players
+}
+
+// handle answers a request or follows a pause from the lobby queue, going
+// by the key it was published with.
+func (l *lobby) handle(body json.RawMessage, meta pubsub.Metadata) (any, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.syncLocked(); err != nil {
+		return nil, err
+	}
+	// The lobby only changes once it is saved, so a request that couldn't
+	// be saved leaves it as it was
+	prev := l.state.clone()
+	now := time.Now()
+	changed := l.expireLocked(now)
+
+	var resp any
+	var err error
+	switch meta.RoutingKey {
+	case routing.JoinKey:
+		var req routing.JoinRequest
+		if err = decodeRequest(body, &req); err == nil {
+			resp, err = l.joinLocked(req, now)
+			changed = true
+		}
+	case routing.WhoKey:
+		resp = routing.WhoResponse{Players: l.playersLocked()}
+	case routing.SpawnKey:
+		var req routing.SpawnRequest
+		if err = decodeRequest(body, &req); err == nil {
+			resp, err = l.spawnLocked(req, now)
+			changed = true
+		}
+	case routing.LeaveKey:
+		var req routing.LeaveRequest
+		if err = decodeRequest(body, &req); err == nil {
+			l.leaveLocked(req)
+			changed = true
+		}
+	case routing.PauseKey:
+		var ps routing.PlayingState
+		if err = decodeRequest(body, &ps); err == nil {
+			l.state.Paused = ps.IsPaused
+			changed = true
+		}
+	default:
+		err = fmt.Errorf("unknown lobby request %s", meta.RoutingKey)
+	}
+
+	if changed {
+		if err := l.saveLocked(); err != nil {
+			l.state = prev
+			return nil, err
+		}
+	}
+	return resp, err
+}
+
+func decodeRequest(body json.RawMessage, req any) error {
+	if err := json.Unmarshal(body, req); err != nil {
+		return fmt.Errorf("couldn't decode request: %w", err)
+	}
+	return nil
+}
+
+func (l *lobby) joinLocked(req routing.JoinRequest, now time.Time) (any, error) {
+	if req.Username == "" {
+		return nil, errors.New("username can't be empty")
+	}
+	resp := routing.JoinResponse{
+		Players:  l.playersLocked(),
+		IsPaused: l.state.Paused,
+	}
+	if _, ok := l.state.Players[req.Username]; !ok {
+		slog.Info("player joined", "username", req.Username)
+	}
+	l.state.Players[req.Username] = now
+	return resp, nil
+}
+
+func (l *lobby) leaveLocked(req routing.LeaveRequest) {
+	if _, ok := l.state.Players[req.Username]; ok {
+		slog.Info("player left", "username", req.Username)
+		delete(l.state.Players, req.Username)
+	}
+}
+
+func (l *lobby) spawnLocked(req routing.SpawnRequest, now time.Time) (any, error) {
+	if _, ok := l.state.Players[req.Username]; !ok {
+		return nil, fmt.Errorf("%s hasn't joined the game", req.Username)
+	}
+	l.state.Players[req.Username] = now
+	if l.state.Paused {
+		return nil, errors.New("the game is paused")
+	}
+	return routing.SpawnResponse{}, gamelogic.ValidateSpawn(req.Location, req.Rank)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func lobbyRequest(t *testing.T, l *lobby, key string, req any) (any, error) {
+	t.Helper()
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.handle(body, pubsub.Metadata{RoutingKey: key})
+}
+
+func openTestLobby(t *testing.T, path string) *lobby {
+	t.Helper()
+	l, err := openLobby(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLobbySurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lobby.json")
+	l := openTestLobby(t, path)
+	if _, err := lobbyRequest(t, l, routing.JoinKey, routing.JoinRequest{Username: "washington"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lobbyRequest(t, l, routing.PauseKey, routing.PlayingState{IsPaused: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	l = openTestLobby(t, path)
+	resp, err := lobbyRequest(t, l, routing.JoinKey, routing.JoinRequest{Username: "lee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := routing.JoinResponse{Players: []string{"washington"}, IsPaused: true}
+	if !reflect.DeepEqual(resp, want) {
+		t.Fatalf("join after restart = %+v, want %+v", resp, want)
+	}
+	if _, err := lobbyRequest(t, l, routing.PauseKey, routing.PlayingState{IsPaused: false}); err != nil {
+		t.Fatal(err)
+	}
+	spawn := routing.SpawnRequest{Username: "washington", Location: "europe", Rank: "infantry"}
+	if _, err := lobbyRequest(t, l, routing.SpawnKey, spawn); err != nil {
+		t.Fatalf("spawn after restart refused: %v", err)
+	}
+}
+
+func TestLobbyTakeover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lobby.json")
+	active := openTestLobby(t, path)
+	standby := openTestLobby(t, path)
+
+	if _, err := lobbyRequest(t, active, routing.JoinKey, routing.JoinRequest{Username: "washington"}); err != nil {
+		t.Fatal(err)
+	}
+	spawn := routing.SpawnRequest{Username: "washington", Location: "europe", Rank: "infantry"}
+	if _, err := lobbyRequest(t, standby, routing.SpawnKey, spawn); err != nil {
+		t.Fatalf("spawn after takeover refused: %v", err)
+	}
+}
+
+func TestLobbyLeaveAndExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lobby.json")
+	l := openTestLobby(t, path)
+	for _, player := range []string{"washington", "lee", "grant"} {
+		if _, err := lobbyRequest(t, l, routing.JoinKey, routing.JoinRequest{Username: player}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := lobbyRequest(t, l, routing.LeaveKey, routing.LeaveRequest{Username: "lee"}); err != nil {
+		t.Fatal(err)
+	}
+	l.state.Players["grant"] = time.Now().Add(-lobbyPlayerTTL)
+
+	resp, err := lobbyRequest(t, l, routing.WhoKey, routing.WhoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := routing.WhoResponse{Players: []string{"washington"}}
+	if !reflect.DeepEqual(resp, want) {
+		t.Fatalf("who = %+v, want %+v", resp, want)
+	}
+
+	spawn := routing.SpawnRequest{Username: "lee", Location: "europe", Rank: "infantry"}
+	if _, err := lobbyRequest(t, l, routing.SpawnKey, spawn); err == nil {
+		t.Fatal("spawn by a player who left was allowed")
+	}
+	if _, ok := openTestLobby(t, path).state.Players["grant"]; ok {
+		t.Fatal("expired player was still saved")
+	}
+}
+
+func TestLobbyUnchangedWhenSaveFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lobby.json")
+	l := openTestLobby(t, path)
+	if _, err := lobbyRequest(t, l, routing.JoinKey, routing.JoinRequest{Username: "washington"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory where the new file would be written stops the save
+	if err := os.Mkdir(path+".tmp", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lobbyRequest(t, l, routing.JoinKey, routing.JoinRequest{Username: "lee"}); err == nil {
+		t.Fatal("join succeeded without being saved")
+	}
+	if _, err := lobbyRequest(t, l, routing.PauseKey, routing.PlayingState{IsPaused: true}); err == nil {
+		t.Fatal("pause succeeded without being saved")
+	}
+
+	resp, err := lobbyRequest(t, l, routing.WhoKey, routing.WhoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (routing.WhoResponse{Players: []string{"washington"}}); !reflect.DeepEqual(resp, want) {
+		t.Fatalf("who after failed saves = %+v, want %+v", resp, want)
+	}
+	if l.state.Paused {
+		t.Fatal("lobby paused without being saved")
+	}
+}
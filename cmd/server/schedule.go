@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+const scheduleUsage = "usage: schedule <pause|resume> <delay like 30s, or RFC 3339 time like 2026-10-18T20:00:00Z>"
+
+// commandSchedule publishes a pause or resume that takes effect later.
+func commandSchedule(ctx context.Context, pub pubsub.DelayPublisher, exchange string, words []string) {
+	if len(words) != 3 {
+		fmt.Println(scheduleUsage)
+		return
+	}
+
+	var state routing.PlayingState
+	switch words[1] {
+	case "pause":
+		state.IsPaused = true
+	case "resume":
+	default:
+		fmt.Println(scheduleUsage)
+		return
+	}
+
+	at, err := parseWhen(words[2], time.Now())
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return
+	}
+	if !at.After(time.Now()) {
+		fmt.Printf("error: %s is in the past\n", at.Format(time.RFC3339))
+		return
+	}
+
+	err = pubsub.PublishAt(
+		ctx,
+		pub,
+		exchange,
+		routing.PauseKey,
+		at,
+		state,
+		pubsub.WithCodec(pubsub.JSON),
+		pubsub.WithPriority(routing.PausePriority),
+	)
+	if err != nil {
+		fmt.Printf("Couldn't schedule %s: %v\n", words[1], err)
+		return
+	}
+	fmt.Printf("Scheduled %s for %s (in %s)\n",
+		words[1], at.Format(time.RFC3339), time.Until(at).Round(time.Second))
+}
+
+// parseWhen reads either a delay from now or an RFC 3339 time.
+func parseWhen(s string, now time.Time) (time.Time, error) {
+	if delay, err := time.ParseDuration(s); err == nil {
+		return now.Add(delay), nil
+	}
+	at, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s is neither a delay nor an RFC 3339 time", s)
+	}
+	return at, nil
+}
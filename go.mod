@@ -3,3 +3,10 @@ module github.com/bootdotdev/learn-pub-sub-starter
 go 1.22.1
 
 require github.com/rabbitmq/amqp091-go v1.10.0
+
+require (
+	github.com/fxamacker/cbor/v2 v2.7.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require github.com/x448/float16 v0.8.4 // indirect
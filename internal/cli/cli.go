@@ -0,0 +1,33 @@
+// Package cli holds what the server and client commands share.
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/tracing"
+)
+
+// Reprompt prints the prompt again after a handler may have printed over it.
+func Reprompt(next func(pubsub.Delivery) pubsub.AckType) func(pubsub.Delivery) pubsub.AckType {
+	return func(d pubsub.Delivery) pubsub.AckType {
+		defer fmt.Print("> ")
+		return next(d)
+	}
+}
+
+// ExportSpans writes spans to path as JSON lines, or to stdout for "-".
+// The returned func closes the file.
+func ExportSpans(path string) (func() error, error) {
+	if path == "-" {
+		tracing.SetExporter(tracing.NewJSONExporter(os.Stdout))
+		return func() error { return nil }, nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open trace file: %w", err)
+	}
+	tracing.SetExporter(tracing.NewJSONExporter(f))
+	return f.Close, nil
+}
@@ -0,0 +1,43 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/tracing"
+)
+
+func TestExportSpans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	for _, name := range []string{"first", "second"} {
+		closeTrace, err := ExportSpans(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, span := tracing.Start(context.Background(), tracing.SpanContext{}, name)
+		span.End()
+		tracing.SetExporter(nil)
+		if err := closeTrace(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"first"`) || !strings.Contains(lines[1], `"second"`) {
+		t.Fatalf("trace file holds %q, want both spans appended", data)
+	}
+}
+
+func TestExportSpansUnwritable(t *testing.T) {
+	if _, err := ExportSpans(filepath.Join(t.TempDir(), "missing", "spans.jsonl")); err == nil {
+		tracing.SetExporter(nil)
+		t.Fatal("exported to a directory that doesn't exist")
+	}
+}
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	yamlFile := write("peril.yaml", "prefetch: 20\nlog_level: debug\n")
+	jsonFile := write("peril.json", `{"prefetch": 25, "exchanges": {"topic": "json_topic"}}`)
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		// want is the prefetch, log level and topic exchange loaded
+		want string
+	}{
+		{"defaults", nil, nil, "10 info peril_topic"},
+		{"file", map[string]string{"PERIL_CONFIG": yamlFile}, nil, "20 debug peril_topic"},
+		{"flag names the file", map[string]string{"PERIL_CONFIG": yamlFile}, []string{"-config", jsonFile}, "25 info json_topic"},
+		{"env over file", map[string]string{"PERIL_CONFIG": yamlFile, "PERIL_PREFETCH": "30"}, nil, "30 debug peril_topic"},
+		{"flag over env", map[string]string{"PERIL_CONFIG": yamlFile, "PERIL_PREFETCH": "30"}, []string{"-prefetch", "40"}, "40 debug peril_topic"},
+		{"flag at its default over env", map[string]string{"PERIL_PREFETCH": "30"}, []string{"-prefetch", "10"}, "10 info peril_topic"},
+		{"env over default", map[string]string{"PERIL_EXCHANGE_TOPIC": "env_topic", "PERIL_LOG_LEVEL": "warn"}, nil, "10 warn env_topic"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("peril", flag.ContinueOnError)
+			loader := Register(fs, Server)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := loader.Load(func(key string) string { return tt.env[key] })
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := fmt.Sprintf("%d %s %s", cfg.Prefetch, cfg.LogLevel, cfg.Exchanges.Topic)
+			if got != tt.want {
+				t.Fatalf("loaded %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	unknown := filepath.Join(dir, "unknown.yaml")
+	toml := filepath.Join(dir, "peril.toml")
+	for path, content := range map[string]string{unknown: "prefetsh: 20\n", toml: ""} {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"unknown setting", map[string]string{"PERIL_CONFIG": unknown}, "couldn't parse config file"},
+		{"missing file", map[string]string{"PERIL_CONFIG": filepath.Join(dir, "missing.yaml")}, "couldn't read config file"},
+		{"unsupported file", map[string]string{"PERIL_CONFIG": toml}, "unsupported config file type"},
+		{"bad env value", map[string]string{"PERIL_PREFETCH": "lots"}, "couldn't parse PERIL_PREFETCH"},
+		{"invalid value", map[string]string{"PERIL_PREFETCH": "-1"}, "prefetch can't be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loader := Register(flag.NewFlagSet("peril", flag.ContinueOnError), Client)
+			_, err := loader.Load(func(key string) string { return tt.env[key] })
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Load() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		role   Role
+		change func(*Config)
+		// want is part of the error, or "" for none
+		want string
+	}{
+		{"defaults", Server, func(*Config) {}, ""},
+		{"client defaults", Client, func(*Config) {}, ""},
+		{"http URL", Client, func(c *Config) { c.AMQPURL = "http://localhost:5672/" }, "must start with amqp://"},
+		{"no host", Client, func(c *Config) { c.AMQPURL = "amqp:///" }, "has no host"},
+		{"TLS over amqp", Client, func(c *Config) { c.TLS.CAFile = "ca.pem" }, "need an amqps:// URL"},
+		{"TLS over amqps", Client, func(c *Config) {
+			c.AMQPURL = "amqps://localhost:5671/"
+			c.TLS.CAFile = "ca.pem"
+		}, ""},
+		{"cert without key", Client, func(c *Config) {
+			c.AMQPURL = "amqps://localhost:5671/"
+			c.TLS.CertFile = "client.pem"
+		}, "certificate and key must be given together"},
+		{"external auth without cert", Client, func(c *Config) {
+			c.AMQPURL = "amqps://localhost:5671/"
+			c.ExternalAuth = true
+		}, "needs a TLS client certificate"},
+		{"external auth with credentials", Client, func(c *Config) {
+			c.AMQPURL = "amqps://localhost:5671/"
+			c.ExternalAuth = true
+			c.TLS.CertFile, c.TLS.KeyFile = "client.pem", "client.key"
+			c.CredentialsFile = "creds"
+		}, "doesn't use a credentials file"},
+		{"empty exchange", Client, func(c *Config) { c.Exchanges.Topic = "" }, "topic exchange name is empty"},
+		{"shared exchange name", Client, func(c *Config) { c.Exchanges.DeadLetter = c.Exchanges.Direct }, "are both named"},
+		{"negative rate", Client, func(c *Config) { c.GameLogRate = -1 }, "rate can't be negative"},
+		{"no burst", Client, func(c *Config) { c.GameLogBurst = 0 }, "burst must be at least 1"},
+		{"unknown over limit", Client, func(c *Config) { c.GameLogOverLimit = "ignore" }, "unknown rate limit action"},
+		{"unknown log format", Client, func(c *Config) { c.LogFormat = "xml" }, "unknown log format"},
+		{"unknown log level", Client, func(c *Config) { c.LogLevel = "loud" }, "couldn't parse log level"},
+		{"client without outbox", Client, func(c *Config) { c.OutboxDir = "" }, "outbox directory is empty"},
+		{"server ignores outbox", Server, func(c *Config) { c.OutboxDir = "" }, ""},
+		{"server without game log", Server, func(c *Config) { c.GameLogFile = "" }, "game log file is empty"},
+		{"server without lobby", Server, func(c *Config) { c.LobbyFile = "" }, "lobby file is empty"},
+		{"server without dead letter queue", Server, func(c *Config) { c.DeadLetterQueue = "" }, "dead letter queue name is empty"},
+		{"no workers", Server, func(c *Config) { c.GameLogWorkers = 0 }, "workers must be at least 1"},
+		{"client ignores workers", Client, func(c *Config) { c.GameLogWorkers = 0 }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.change(&cfg)
+			err := cfg.Validate(tt.role)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Fatalf("Validate() = %v, want nil", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package gamelogic
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -18,6 +19,7 @@ func PrintClientHelp() {
 	fmt.Println("    example:")
 	fmt.Println("    spawn europe infantry")
 	fmt.Println("* status")
+	fmt.Println("* who")
 	fmt.Println("* spam <n>")
 	fmt.Println("    example:")
 	fmt.Println("    spam 5")
@@ -42,6 +44,12 @@ func PrintServerHelp() {
 	fmt.Println("Possible commands:")
 	fmt.Println("* pause")
 	fmt.Println("* resume")
+	fmt.Println("* schedule <pause|resume> <delay|time>")
+	fmt.Println("* throttled")
+	fmt.Println("* dlq list")
+	fmt.Println("* dlq show <n>")
+	fmt.Println("* dlq replay <n|all>")
+	fmt.Println("* dlq purge")
 	fmt.Println("* quit")
 	fmt.Println("* help")
 }
@@ -58,6 +66,21 @@ func GetInput() []string {
 	return strings.Fields(line)
 }
 
+// GetInputContext is GetInput that gives up when ctx is cancelled, so a
+// REPL blocked on stdin can still shut down on a signal.
+func GetInputContext(ctx context.Context) ([]string, error) {
+	words := make(chan []string, 1)
+	go func() {
+		words <- GetInput()
+	}()
+	select {
+	case w := <-words:
+		return w, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 func GetMaliciousLog() string {
 	possibleLogs := []string{
 		"Never interrupt your enemy when he is making a mistake.",
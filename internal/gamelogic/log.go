@@ -0,0 +1,21 @@
+package gamelogic
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+var pkgLogger atomic.Pointer[slog.Logger]
+
+// SetLogger sets where gamelogic logs. Game narration isn't logging and
+// always goes to stdout.
+func SetLogger(l *slog.Logger) {
+	pkgLogger.Store(l)
+}
+
+func logger() *slog.Logger {
+	if l := pkgLogger.Load(); l != nil {
+		return l
+	}
+	return slog.Default()
+}
@@ -2,7 +2,6 @@ package gamelogic
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"time"
 
@@ -14,10 +13,15 @@ const logsFile = "game.log"
 const writeToDiskSleep = 1 * time.Second
 
 func WriteLog(gamelog routing.GameLog) error {
-	log.Printf("received game log...")
+	return WriteLogTo(logsFile, gamelog)
+}
+
+// WriteLogTo is WriteLog appending to path instead of game.log.
+func WriteLogTo(path string, gamelog routing.GameLog) error {
+	logger().Info("writing game log", "username", gamelog.Username, "file", path)
 	time.Sleep(writeToDiskSleep)
 
-	f, err := os.OpenFile(logsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("could not open logs file: %v", err)
 	}
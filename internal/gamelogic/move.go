@@ -50,6 +50,18 @@ func getOverlappingLocation(p1 Player, p2 Player) Location {
 }
 
 func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
+	mv, err := gs.PlanMove(words)
+	if err != nil {
+		return ArmyMove{}, err
+	}
+	gs.ApplyMove(mv)
+	return mv, nil
+}
+
+// PlanMove checks a move command and returns the move it would make,
+// without moving anything, so the move can be recorded before it happens.
+// ApplyMove carries it out.
+func (gs *GameState) PlanMove(words []string) (ArmyMove, error) {
 	if gs.isPaused() {
 		return ArmyMove{}, errors.New("the game is paused, you can not move units")
 	}
@@ -71,22 +83,30 @@ func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
 		unitIDs = append(unitIDs, unitID)
 	}
 
+	// The snapshot is the player as they will be after the move
+	player := gs.GetPlayerSnap()
 	newUnits := []Unit{}
 	for _, unitID := range unitIDs {
-		unit, ok := gs.GetUnit(unitID)
+		unit, ok := player.Units[unitID]
 		if !ok {
 			return ArmyMove{}, fmt.Errorf("error: unit with ID %v not found", unitID)
 		}
 		unit.Location = newLocation
-		gs.UpdateUnit(unit)
+		player.Units[unitID] = unit
 		newUnits = append(newUnits, unit)
 	}
 
-	mv := ArmyMove{
+	return ArmyMove{
 		ToLocation: newLocation,
 		Units:      newUnits,
-		Player:     gs.GetPlayerSnap(),
+		Player:     player,
+	}, nil
+}
+
+// ApplyMove moves the units of a move from PlanMove.
+func (gs *GameState) ApplyMove(mv ArmyMove) {
+	for _, unit := range mv.Units {
+		gs.UpdateUnit(unit)
 	}
 	fmt.Printf("Moved %v units to %s\n", len(mv.Units), mv.ToLocation)
-	return mv, nil
 }
@@ -5,30 +5,43 @@ import (
 	"fmt"
 )
 
-func (gs *GameState) CommandSpawn(words []string) error {
+// ParseSpawn checks a spawn command without spawning anything.
+func ParseSpawn(words []string) (Location, UnitRank, error) {
 	if len(words) < 3 {
-		return errors.New("usage: spawn <location> <rank>")
+		return "", "", errors.New("usage: spawn <location> <rank>")
+	}
+	if err := ValidateSpawn(words[1], words[2]); err != nil {
+		return "", "", err
 	}
+	return Location(words[1]), UnitRank(words[2]), nil
+}
 
-	locationName := words[1]
+func ValidateSpawn(locationName, rank string) error {
 	locations := getAllLocations()
 	if _, ok := locations[Location(locationName)]; !ok {
 		return fmt.Errorf("error: %s is not a valid location", locationName)
 	}
 
-	rank := words[2]
 	units := getAllRanks()
 	if _, ok := units[UnitRank(rank)]; !ok {
 		return fmt.Errorf("error: %s is not a valid unit", rank)
 	}
+	return nil
+}
+
+func (gs *GameState) CommandSpawn(words []string) error {
+	location, rank, err := ParseSpawn(words)
+	if err != nil {
+		return err
+	}
 
 	id := len(gs.getUnitsSnap()) + 1
 	gs.addUnit(Unit{
 		ID:       id,
-		Rank:     UnitRank(rank),
-		Location: Location(locationName),
+		Rank:     rank,
+		Location: location,
 	})
 
-	fmt.Printf("Spawned a(n) %s in %s with id %v\n", rank, locationName, id)
+	fmt.Printf("Spawned a(n) %s in %s with id %v\n", rank, location, id)
 	return nil
 }
@@ -0,0 +1,314 @@
+// Package metrics is a small registry of counters, gauges and histograms
+// that can be read in-process or served in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets suit latencies measured in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultRegistry is where metrics go unless told otherwise.
+var DefaultRegistry = NewRegistry()
+
+type kind string
+
+const (
+	kindCounter   kind = "counter"
+	kindGauge     kind = "gauge"
+	kindHistogram kind = "histogram"
+)
+
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// family is every series of one metric, keyed by their label values.
+type family struct {
+	name       string
+	help       string
+	kind       kind
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+
+	mu     sync.Mutex
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// register returns the family called name, creating it the first time.
+// Asking for an existing name with a different kind or labels panics, as
+// that's a programming error.
+func (r *Registry) register(name, help string, k kind, buckets []float64, labelNames []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.kind != k || strings.Join(f.labelNames, ",") != strings.Join(labelNames, ",") {
+			panic(fmt.Sprintf("metric %s already registered as a %s with labels %v", name, f.kind, f.labelNames))
+		}
+		return f
+	}
+	f := &family{
+		name:       name,
+		help:       help,
+		kind:       k,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     map[string]*series{},
+	}
+	r.families[name] = f
+	return f
+}
+
+func (f *family) with(labelValues []string) *series {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == kindHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+type CounterVec struct{ f *family }
+
+type Counter struct{ s *series }
+
+func (r *Registry) Counter(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{r.register(name, help, kindCounter, nil, labelNames)}
+}
+
+func (v *CounterVec) With(labelValues ...string) Counter {
+	return Counter{v.f.with(labelValues)}
+}
+
+func (c Counter) Inc() {
+	c.Add(1)
+}
+
+// Add panics if delta is negative, since counters only go up.
+func (c Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("counter can't decrease")
+	}
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	c.s.value += delta
+}
+
+func (c Counter) Value() float64 {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	return c.s.value
+}
+
+type GaugeVec struct{ f *family }
+
+type Gauge struct{ s *series }
+
+func (r *Registry) Gauge(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{r.register(name, help, kindGauge, nil, labelNames)}
+}
+
+func (v *GaugeVec) With(labelValues ...string) Gauge {
+	return Gauge{v.f.with(labelValues)}
+}
+
+func (g Gauge) Set(value float64) {
+	g.s.mu.Lock()
+	defer g.s.mu.Unlock()
+	g.s.value = value
+}
+
+func (g Gauge) Add(delta float64) {
+	g.s.mu.Lock()
+	defer g.s.mu.Unlock()
+	g.s.value += delta
+}
+
+func (g Gauge) Value() float64 {
+	g.s.mu.Lock()
+	defer g.s.mu.Unlock()
+	return g.s.value
+}
+
+type HistogramVec struct{ f *family }
+
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// Histogram counts observations into buckets, given as their upper bounds.
+// Nil buckets means DefaultBuckets.
+func (r *Registry) Histogram(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &HistogramVec{r.register(name, help, kindHistogram, buckets, labelNames)}
+}
+
+func (v *HistogramVec) With(labelValues ...string) Histogram {
+	return Histogram{s: v.f.with(labelValues), buckets: v.f.buckets}
+}
+
+func (h Histogram) Observe(value float64) {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	// counts are per bucket here and only made cumulative when written out
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		h.s.counts[i]++
+	}
+	h.s.sum += value
+	h.s.count++
+}
+
+func (h Histogram) Count() uint64 {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	return h.s.count
+}
+
+func (h Histogram) Sum() float64 {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	return h.s.sum
+}
+
+// WriteText writes every metric in the Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	var b strings.Builder
+	for _, f := range families {
+		f.writeText(&b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *family) writeText(b *strings.Builder) {
+	f.mu.Lock()
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	f.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].labelValues, "\xff") < strings.Join(all[j].labelValues, "\xff")
+	})
+
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.kind)
+	for _, s := range all {
+		s.mu.Lock()
+		labels := formatLabels(f.labelNames, s.labelValues)
+		if f.kind != kindHistogram {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, labels(), formatFloat(s.value))
+			s.mu.Unlock()
+			continue
+		}
+		var cumulative uint64
+		for i, le := range f.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, labels("le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, labels("le", "+Inf"), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, labels(), formatFloat(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, labels(), s.count)
+		s.mu.Unlock()
+	}
+}
+
+// formatLabels returns a func that renders the series' labels plus any
+// extra name/value pairs.
+func formatLabels(names, values []string) func(extra ...string) string {
+	return func(extra ...string) string {
+		pairs := make([]string, 0, len(names)+len(extra)/2)
+		for i, name := range names {
+			pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+		}
+		if len(pairs) == 0 {
+			return ""
+		}
+		return "{" + strings.Join(pairs, ",") + "}"
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// Handler serves the registry for Prometheus to scrape.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.WriteText(w); err != nil {
+			slog.Error("couldn't write metrics", "err", err)
+		}
+	})
+}
@@ -0,0 +1,1071 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	ErrNotConnected      = errors.New("not connected to broker")
+	ErrPublishBufferFull = errors.New("publish buffer is full")
+	ErrPublishNacked     = errors.New("broker nacked message")
+)
+
+// returnBufferSize is how many returned messages can wait between publishes
+const returnBufferSize = 16
+
+type AMQPConfig struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// PublishTimeout bounds how long Publish waits for a reconnect when the
+	// caller's context has no deadline. Zero waits indefinitely.
+	PublishTimeout time.Duration
+	// PublishBufferSize, when positive, makes Publish buffer up to that many
+	// messages during an outage instead of waiting for a reconnect.
+	PublishBufferSize int
+	// PublisherConfirms puts the publish channel in confirm mode so Publish
+	// waits for the broker to accept each message. It is also what lets
+	// Publish report mandatory messages that couldn't be routed.
+	PublisherConfirms bool
+	// Metrics records publishes and deliveries. Nil records nothing.
+	Metrics *Metrics
+	// TLS secures amqps:// connections. Nil trusts the system roots and
+	// checks the host in the URL.
+	TLS *tls.Config
+	// Credentials, when set, replace the user and password in the URL.
+	Credentials *Credentials
+	// ExternalAuth logs in with SASL EXTERNAL, letting the broker take the
+	// user from the client certificate in TLS.
+	ExternalAuth bool
+}
+
+func DefaultAMQPConfig() AMQPConfig {
+	return AMQPConfig{
+		InitialBackoff:    500 * time.Millisecond,
+		MaxBackoff:        30 * time.Second,
+		PublishTimeout:    10 * time.Second,
+		PublisherConfirms: true,
+		Metrics:           DefaultMetrics,
+	}
+}
+
+// AMQPBroker is a Broker backed by RabbitMQ. It owns its connection and
+// transparently redials, reopens its publish channel and re-establishes
+// every subscription when the connection drops.
+type AMQPBroker struct {
+	url    string
+	config AMQPConfig
+
+	mu        sync.Mutex
+	conn      *amqp.Connection
+	publishCh *amqp.Channel
+	returns   chan amqp.Return
+	// connected is closed while a connection is up and replaced on loss
+	connected chan struct{}
+	subs      []*amqpSubscription
+	tagSeq    int
+	buffer    []bufferedPublish
+	closed    bool
+	done      chan struct{}
+}
+
+type amqpSubscription struct {
+	exchange    string
+	queueName   string
+	key         string
+	queue       QueueOptions
+	consumerTag string
+	options     subscribeOptions
+	deliveries  chan inbound
+	// ch is the channel currently consuming, nil while disconnected
+	ch     *amqp.Channel
+	sub    *Subscription
+	closed bool
+}
+
+type bufferedPublish struct {
+	exchange string
+	key      string
+	msg      Message
+}
+
+func DialAMQPBroker(url string, config AMQPConfig) (*AMQPBroker, error) {
+	uri, err := amqp.ParseURI(url)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse AMQP URL: %w", err)
+	}
+	if uri.Scheme != "amqps" && (config.TLS != nil || config.ExternalAuth) {
+		return nil, errors.New("TLS and EXTERNAL auth need an amqps:// URL")
+	}
+	if config.ExternalAuth && config.Credentials != nil {
+		return nil, errors.New("EXTERNAL auth doesn't use credentials")
+	}
+
+	b := &AMQPBroker{
+		url:       url,
+		config:    config,
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if err := b.connect(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *AMQPBroker) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	start := time.Now()
+	err := b.publish(ctx, exchange, key, msg)
+	b.config.Metrics.observePublish(exchange, key, time.Since(start), err)
+	return err
+}
+
+func (b *AMQPBroker) publish(ctx context.Context, exchange, key string, msg Message) error {
+	if _, ok := ctx.Deadline(); !ok && b.config.PublishTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.config.PublishTimeout)
+		defer cancel()
+	}
+
+	for {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return errBrokerClosed
+		}
+
+		ch, err := b.publishChannelLocked()
+		if err != nil {
+			b.mu.Unlock()
+			return err
+		}
+		if ch != nil {
+			err := b.publishLocked(ctx, ch, exchange, key, msg)
+			if !errors.Is(err, amqp.ErrClosed) {
+				b.mu.Unlock()
+				return err
+			}
+			// The channel died under us. Try again on a fresh one, or wait
+			// for the reconnect if the whole connection is gone.
+			b.mu.Unlock()
+			continue
+		}
+
+		if b.config.PublishBufferSize > 0 {
+			defer b.mu.Unlock()
+			if len(b.buffer) >= b.config.PublishBufferSize {
+				return ErrPublishBufferFull
+			}
+			b.buffer = append(b.buffer, bufferedPublish{
+				exchange: exchange,
+				key:      key,
+				msg:      copyMessage(msg),
+			})
+			return nil
+		}
+
+		connected := b.connected
+		b.mu.Unlock()
+		select {
+		case <-connected:
+		case <-b.done:
+			return errBrokerClosed
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ErrNotConnected, ctx.Err())
+		}
+	}
+}
+
+// PublishBatch publishes msgs in order and, in confirm mode, waits for the
+// broker to ack all of them at once.
+func (b *AMQPBroker) PublishBatch(ctx context.Context, msgs []Envelope) []error {
+	start := time.Now()
+	errs := b.publishBatch(ctx, msgs)
+	took := time.Since(start)
+	for i, m := range msgs {
+		b.config.Metrics.observePublish(m.Exchange, m.Key, took, errs[i])
+	}
+	return errs
+}
+
+func (b *AMQPBroker) publishBatch(ctx context.Context, msgs []Envelope) []error {
+	if _, ok := ctx.Deadline(); !ok && b.config.PublishTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.config.PublishTimeout)
+		defer cancel()
+	}
+
+	errs := make([]error, len(msgs))
+	todo := make([]int, len(msgs))
+	for i := range todo {
+		todo[i] = i
+	}
+	fail := func(err error) []error {
+		for _, i := range todo {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	for len(todo) > 0 {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return fail(errBrokerClosed)
+		}
+
+		ch, err := b.publishChannelLocked()
+		if err != nil {
+			b.mu.Unlock()
+			return fail(err)
+		}
+		if ch != nil {
+			batch := make([]Envelope, len(todo))
+			for j, i := range todo {
+				batch[j] = msgs[i]
+			}
+			results := b.publishBatchLocked(ctx, ch, batch)
+			b.mu.Unlock()
+
+			// Messages lost with the channel go again on a fresh one
+			var retry []int
+			for j, i := range todo {
+				if errors.Is(results[j], amqp.ErrClosed) {
+					retry = append(retry, i)
+					continue
+				}
+				errs[i] = results[j]
+			}
+			todo = retry
+			continue
+		}
+
+		if b.config.PublishBufferSize > 0 {
+			for _, i := range todo {
+				if len(b.buffer) >= b.config.PublishBufferSize {
+					errs[i] = ErrPublishBufferFull
+					continue
+				}
+				b.buffer = append(b.buffer, bufferedPublish{
+					exchange: msgs[i].Exchange,
+					key:      msgs[i].Key,
+					msg:      copyMessage(msgs[i].Message),
+				})
+			}
+			b.mu.Unlock()
+			return errs
+		}
+
+		connected := b.connected
+		b.mu.Unlock()
+		select {
+		case <-connected:
+		case <-b.done:
+			return fail(errBrokerClosed)
+		case <-ctx.Done():
+			return fail(fmt.Errorf("%w: %w", ErrNotConnected, ctx.Err()))
+		}
+	}
+	return errs
+}
+
+func (b *AMQPBroker) Subscribe(
+	ctx context.Context,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	handler func(Delivery) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	options := newSubscribeOptions(opts)
+	queue, err := options.queueOptions(simpleQueueType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for queue %s: %w", queueName, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, errBrokerClosed
+	}
+
+	b.tagSeq++
+	as := &amqpSubscription{
+		exchange:    exchange,
+		queueName:   queueName,
+		key:         key,
+		queue:       queue,
+		consumerTag: fmt.Sprintf("%s-%d", queueName, b.tagSeq),
+		options:     options,
+		deliveries:  make(chan inbound),
+	}
+	as.sub = newSubscription(
+		queueName,
+		b,
+		b.config.Metrics,
+		func() error { return b.cancelSubscription(as) },
+		func() error { return b.releaseSubscription(as) },
+	)
+
+	// While disconnected the subscription is only registered; connect()
+	// starts consuming once the broker is back.
+	if b.conn != nil {
+		if err := b.consumeLocked(b.conn, as); err != nil {
+			return nil, err
+		}
+	}
+	b.subs = append(b.subs, as)
+
+	as.sub.start(ctx, as.deliveries, handler, as.options)
+	return as.sub, nil
+}
+
+// cancelSubscription forgets as, so it isn't restored on reconnect, and
+// cancels its consumer so RabbitMQ stops sending it messages.
+func (b *AMQPBroker) cancelSubscription(as *amqpSubscription) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	as.closed = true
+	for i, other := range b.subs {
+		if other == as {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			break
+		}
+	}
+	if as.ch == nil {
+		return nil
+	}
+	if err := as.ch.Cancel(as.consumerTag, false); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		return fmt.Errorf("couldn't cancel consumer %s: %w", as.consumerTag, err)
+	}
+	return nil
+}
+
+// releaseSubscription closes the consumer's channel, which makes RabbitMQ
+// requeue anything it delivered that was never settled.
+func (b *AMQPBroker) releaseSubscription(as *amqpSubscription) error {
+	b.mu.Lock()
+	ch := as.ch
+	as.ch = nil
+	b.mu.Unlock()
+
+	if ch == nil {
+		return nil
+	}
+	if err := ch.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		return fmt.Errorf("couldn't close consumer channel: %w", err)
+	}
+	return nil
+}
+
+func (b *AMQPBroker) DeclareExchange(name string, kind ExchangeKind) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch, err := b.publishChannelLocked()
+	if err != nil {
+		return err
+	}
+	if ch == nil {
+		return ErrNotConnected
+	}
+	return ch.ExchangeDeclare(
+		name,         // name
+		string(kind), // kind
+		true,         // durable
+		false,        // auto-delete
+		false,        // internal
+		false,        // no-wait
+		nil,          // args
+	)
+}
+
+func (b *AMQPBroker) DeclareQueue(name string, simpleQueueType SimpleQueueType, args map[string]any) error {
+	return b.DeclareQueueWithOptions(name, simpleQueueType.QueueOptions(), args)
+}
+
+func (b *AMQPBroker) DeclareQueueWithOptions(name string, q QueueOptions, args map[string]any) error {
+	if err := q.Validate(); err != nil {
+		return fmt.Errorf("invalid options for queue %s: %w", name, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch, err := b.publishChannelLocked()
+	if err != nil {
+		return err
+	}
+	if ch == nil {
+		return ErrNotConnected
+	}
+	_, err = ch.QueueDeclare(
+		name,                         // name
+		q.Durable,                    // durable
+		q.AutoDelete,                 // delete when unused
+		q.Exclusive,                  // exclusive
+		false,                        // no-wait
+		amqp.Table(q.argsWith(args)), // arguments
+	)
+	return err
+}
+
+func (b *AMQPBroker) BindQueue(queueName, key, exchange string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch, err := b.publishChannelLocked()
+	if err != nil {
+		return err
+	}
+	if ch == nil {
+		return ErrNotConnected
+	}
+	return ch.QueueBind(
+		queueName, // queue name
+		key,       // routing key
+		exchange,  // exchange
+		false,     // no-wait
+		nil,       // args
+	)
+}
+
+// VerifyExchange passively checks the exchange exists, then redeclares it,
+// which is a no-op when it matches and a PRECONDITION_FAILED when it doesn't.
+func (b *AMQPBroker) VerifyExchange(name string, kind ExchangeKind) error {
+	err := b.withScratchChannel(func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclarePassive(name, string(kind), true, false, false, false, nil)
+	})
+	if err != nil {
+		return err
+	}
+	return b.withScratchChannel(func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclare(name, string(kind), true, false, false, false, nil)
+	})
+}
+
+func (b *AMQPBroker) VerifyQueue(name string, simpleQueueType SimpleQueueType, args map[string]any) error {
+	return b.VerifyQueueWithOptions(name, simpleQueueType.QueueOptions(), args)
+}
+
+func (b *AMQPBroker) VerifyQueueWithOptions(name string, q QueueOptions, args map[string]any) error {
+	table := amqp.Table(q.argsWith(args))
+	err := b.withScratchChannel(func(ch *amqp.Channel) error {
+		_, err := ch.QueueDeclarePassive(name, q.Durable, q.AutoDelete, q.Exclusive, false, table)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return b.withScratchChannel(func(ch *amqp.Channel) error {
+		_, err := ch.QueueDeclare(name, q.Durable, q.AutoDelete, q.Exclusive, false, table)
+		return err
+	})
+}
+
+// VerifyBinding always fails: AMQP 0-9-1 has no way to look up a binding.
+func (b *AMQPBroker) VerifyBinding(queueName, key, exchange string) error {
+	return fmt.Errorf("binding of %s to %s with key %s: %w", queueName, exchange, key, ErrCannotVerify)
+}
+
+func (b *AMQPBroker) Inspect(queue string, max int, fn func(i int, d Delivery) bool) error {
+	return b.withScratchChannel(func(ch *amqp.Channel) error {
+		// Fetched messages stay unacked until the end, so they aren't
+		// fetched twice; closing the channel puts back any left unsettled
+		var msgs []amqp.Delivery
+		for max <= 0 || len(msgs) < max {
+			msg, ok, err := ch.Get(queue, false)
+			if err != nil {
+				return fmt.Errorf("couldn't get message from %s: %w", queue, err)
+			}
+			if !ok {
+				break
+			}
+			msgs = append(msgs, msg)
+		}
+
+		var errs []error
+		for i, msg := range msgs {
+			if fn(i, fromAMQPDelivery(queue, msg).Delivery) {
+				errs = append(errs, msg.Ack(false))
+			} else {
+				errs = append(errs, msg.Nack(false, true))
+			}
+		}
+		return errors.Join(errs...)
+	})
+}
+
+func (b *AMQPBroker) Purge(queue string) (int, error) {
+	var n int
+	err := b.withScratchChannel(func(ch *amqp.Channel) error {
+		var err error
+		n, err = ch.QueuePurge(queue, false)
+		return err
+	})
+	return n, err
+}
+
+// withScratchChannel runs f on a channel of its own, since a failed
+// declaration closes the channel it was made on.
+func (b *AMQPBroker) withScratchChannel(f func(ch *amqp.Channel) error) error {
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("couldn't create channel: %w", err)
+	}
+	defer ch.Close()
+
+	var amqpErr *amqp.Error
+	err = f(ch)
+	if errors.As(err, &amqpErr) {
+		switch amqpErr.Code {
+		case amqp.NotFound:
+			return fmt.Errorf("%w: %s", ErrNotFound, amqpErr.Reason)
+		case amqp.PreconditionFailed:
+			return fmt.Errorf("%w: %s", ErrInequivalent, amqpErr.Reason)
+		}
+	}
+	return err
+}
+
+// Close drains every subscription, then closes the connection.
+func (b *AMQPBroker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	subs := append([]*amqpSubscription(nil), b.subs...)
+	b.mu.Unlock()
+
+	var errs []error
+	for _, as := range subs {
+		errs = append(errs, as.sub.Close())
+	}
+
+	b.mu.Lock()
+	conn := b.conn
+	b.conn = nil
+	b.publishCh = nil
+	b.mu.Unlock()
+	if conn != nil {
+		errs = append(errs, conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// connect dials RabbitMQ and restores the publish channel and every
+// registered subscription on the new connection.
+func (b *AMQPBroker) connect() error {
+	conn, err := b.dial()
+	if err != nil {
+		return fmt.Errorf("couldn't connect to RabbitMQ: %w", err)
+	}
+	closeCh := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	publishCh, returns, err := b.openPublishChannel(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		conn.Close()
+		return errBrokerClosed
+	}
+	for _, sub := range b.subs {
+		// One queue that can't be consumed mustn't keep every other
+		// subscription and publisher down, so it is retried on its own
+		if err := b.consumeLocked(conn, sub); err != nil {
+			logger().Error("couldn't resubscribe", "queue", sub.queueName, "err", err)
+			sub.ch = nil
+			go b.restartConsumer(conn, sub)
+		}
+	}
+	b.conn = conn
+	b.publishCh = publishCh
+	b.returns = returns
+	close(b.connected)
+
+	// A confirm that never comes mustn't hold b.mu for good
+	timeout := b.config.PublishTimeout
+	if timeout <= 0 {
+		timeout = DefaultAMQPConfig().PublishTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	buffered := b.buffer
+	b.buffer = nil
+	for _, p := range buffered {
+		if err := b.publishLocked(ctx, publishCh, p.exchange, p.key, p.msg); err != nil {
+			logger().Error("couldn't publish buffered message",
+				"exchange", p.exchange,
+				"routing_key", p.key,
+				"message_id", p.msg.MessageID,
+				"err", err,
+			)
+		}
+	}
+
+	go b.watch(conn, closeCh)
+	return nil
+}
+
+func (b *AMQPBroker) dial() (*amqp.Connection, error) {
+	config := amqp.Config{
+		Locale: "en_US",
+	}
+	if b.config.TLS != nil {
+		// The client library fills in ServerName, so every dial gets a copy
+		config.TLSClientConfig = b.config.TLS.Clone()
+	}
+	switch {
+	case b.config.ExternalAuth:
+		config.SASL = []amqp.Authentication{&amqp.ExternalAuth{}}
+	case b.config.Credentials != nil:
+		config.SASL = []amqp.Authentication{&amqp.PlainAuth{
+			Username: b.config.Credentials.Username,
+			Password: b.config.Credentials.Password,
+		}}
+	}
+	return amqp.DialConfig(b.url, config)
+}
+
+// watch waits for conn to close and, unless the broker itself was closed,
+// redials with exponential backoff.
+func (b *AMQPBroker) watch(conn *amqp.Connection, closeCh <-chan *amqp.Error) {
+	amqpErr := <-closeCh
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	if b.conn == conn {
+		b.markDisconnectedLocked()
+	}
+	b.mu.Unlock()
+
+	logger().Warn("lost connection to RabbitMQ, reconnecting", "err", amqpErr)
+	backoff := b.config.InitialBackoff
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-time.After(backoff):
+		}
+
+		err := b.connect()
+		if err == nil {
+			logger().Info("reconnected to RabbitMQ")
+			return
+		}
+		if errors.Is(err, errBrokerClosed) {
+			return
+		}
+		logger().Warn("couldn't reconnect to RabbitMQ", "err", err)
+		backoff = nextBackoff(backoff, b.config.MaxBackoff)
+	}
+}
+
+func (b *AMQPBroker) markDisconnectedLocked() {
+	b.conn = nil
+	b.publishCh = nil
+	b.returns = nil
+	b.connected = make(chan struct{})
+}
+
+// publishChannelLocked returns an open publish channel, reopening it if only
+// the channel was closed, or nil if the connection is down.
+func (b *AMQPBroker) publishChannelLocked() (*amqp.Channel, error) {
+	if b.conn == nil {
+		return nil, nil
+	}
+	if b.conn.IsClosed() {
+		b.markDisconnectedLocked()
+		return nil, nil
+	}
+	if b.publishCh == nil || b.publishCh.IsClosed() {
+		ch, returns, err := b.openPublishChannel(b.conn)
+		if err != nil {
+			return nil, err
+		}
+		b.publishCh = ch
+		b.returns = returns
+	}
+	return b.publishCh, nil
+}
+
+func (b *AMQPBroker) openPublishChannel(conn *amqp.Connection) (*amqp.Channel, chan amqp.Return, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't create publish channel: %w", err)
+	}
+	if !b.config.PublisherConfirms {
+		return ch, nil, nil
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, nil, fmt.Errorf("couldn't put publish channel in confirm mode: %w", err)
+	}
+	// Publishes read returns while they wait for their acks. The buffer
+	// holds the late ones of publishes that timed out until the next
+	// publish, so they don't block the client library in between.
+	returns := ch.NotifyReturn(make(chan amqp.Return, returnBufferSize))
+	return ch, returns, nil
+}
+
+// publishLocked publishes on ch and, in confirm mode, waits for the broker
+// to ack the message. A return left over from an earlier publish that timed
+// out is told apart by its message ID, exchange and key.
+func (b *AMQPBroker) publishLocked(ctx context.Context, ch *amqp.Channel, exchange, key string, msg Message) error {
+	if !b.config.PublisherConfirms {
+		return ch.PublishWithContext(ctx, exchange, key, msg.Mandatory, false, toAMQPPublishing(msg))
+	}
+
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, msg.Mandatory, false, toAMQPPublishing(msg))
+	if err != nil {
+		return err
+	}
+
+	// Returns have to be read while waiting, or the client library blocks
+	// on handing them over and the ack behind them never arrives
+	var unroutable *UnroutableError
+	for done := false; !done; {
+		select {
+		case <-confirm.Done():
+			done = true
+		case ret := <-b.returns:
+			if err := returnedError(ret, exchange, key, msg); err != nil {
+				unroutable = err
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("couldn't confirm publish: %w", ctx.Err())
+		}
+	}
+	if !confirm.Acked() {
+		if ch.IsClosed() {
+			// Pending confirms are nacked when the channel goes away.
+			return amqp.ErrClosed
+		}
+		return ErrPublishNacked
+	}
+
+	// RabbitMQ sends basic.return before the ack of the same message, and
+	// the client library hands it over before processing that ack, so it
+	// is here by now if it isn't already read
+	for {
+		select {
+		case ret := <-b.returns:
+			if err := returnedError(ret, exchange, key, msg); err != nil {
+				unroutable = err
+			}
+		default:
+			if unroutable != nil {
+				return unroutable
+			}
+			return nil
+		}
+	}
+}
+
+// returnedError is the error for ret if it is the return of msg, published
+// to exchange with key, and nil if it belongs to another message.
+func returnedError(ret amqp.Return, exchange, key string, msg Message) *UnroutableError {
+	if ret.Exchange != exchange || ret.RoutingKey != key || ret.MessageId != msg.MessageID {
+		return nil
+	}
+	return &UnroutableError{
+		Exchange:   ret.Exchange,
+		RoutingKey: ret.RoutingKey,
+		Reason:     ret.ReplyText,
+	}
+}
+
+// publishBatchLocked publishes msgs on ch and, in confirm mode, waits for
+// every ack. Returns are matched to their message by ID, exchange and key,
+// since the batch is in flight together.
+func (b *AMQPBroker) publishBatchLocked(ctx context.Context, ch *amqp.Channel, msgs []Envelope) []error {
+	errs := make([]error, len(msgs))
+	if !b.config.PublisherConfirms {
+		for i, m := range msgs {
+			errs[i] = ch.PublishWithContext(ctx, m.Exchange, m.Key, m.Message.Mandatory, false, toAMQPPublishing(m.Message))
+		}
+		return errs
+	}
+
+	confirms := make([]*amqp.DeferredConfirmation, len(msgs))
+	for i, m := range msgs {
+		confirms[i], errs[i] = ch.PublishWithDeferredConfirmWithContext(ctx, m.Exchange, m.Key, m.Message.Mandatory, false, toAMQPPublishing(m.Message))
+	}
+
+	// Returns have to be read while waiting, or the client library blocks
+	// on handing them over and the acks behind them never arrive
+	var returned []amqp.Return
+	for i, confirm := range confirms {
+		if confirm == nil {
+			continue
+		}
+	wait:
+		for {
+			select {
+			case <-confirm.Done():
+				break wait
+			case ret := <-b.returns:
+				returned = append(returned, ret)
+			case <-ctx.Done():
+				for j := i; j < len(confirms); j++ {
+					if confirms[j] != nil {
+						errs[j] = fmt.Errorf("couldn't confirm publish: %w", ctx.Err())
+					}
+				}
+				return errs
+			}
+		}
+		if !confirm.Acked() {
+			if ch.IsClosed() {
+				// Pending confirms are nacked when the channel goes away.
+				errs[i] = amqp.ErrClosed
+			} else {
+				errs[i] = ErrPublishNacked
+			}
+		}
+	}
+
+drain:
+	for {
+		select {
+		case ret := <-b.returns:
+			returned = append(returned, ret)
+		default:
+			break drain
+		}
+	}
+	for _, ret := range returned {
+		for i, m := range msgs {
+			if errs[i] != nil {
+				continue
+			}
+			if err := returnedError(ret, m.Exchange, m.Key, m.Message); err != nil {
+				errs[i] = err
+				break
+			}
+		}
+	}
+	return errs
+}
+
+func (b *AMQPBroker) consumeLocked(conn *amqp.Connection, sub *amqpSubscription) error {
+	ch, queue, err := declareAndBind(conn, sub.exchange, sub.queueName, sub.key, sub.queue)
+	if err != nil {
+		return fmt.Errorf("couldn't declare and bind queue: %w", err)
+	}
+
+	// Prefetch configuration
+	if err := ch.Qos(sub.options.prefetchCount, sub.options.prefetchSize, false); err != nil {
+		ch.Close()
+		return fmt.Errorf("couldn't set channel prefetch count: %w", err)
+	}
+	deliveryChan, err := ch.Consume(
+		queue.Name,      // queue
+		sub.consumerTag, // consumer
+		false,           // auto-ack
+		false,           // exclusive
+		false,           // no-Local
+		false,           // no-Wait
+		nil,             //args
+	)
+	if err != nil {
+		ch.Close()
+		return fmt.Errorf("couldn't start consuming: %w", err)
+	}
+
+	sub.ch = ch
+	go b.pump(conn, sub, deliveryChan)
+	return nil
+}
+
+// pump forwards deliveries from one AMQP channel to the subscription. If the
+// channel closes while its connection is still up, the consumer is restarted.
+func (b *AMQPBroker) pump(conn *amqp.Connection, sub *amqpSubscription, deliveryChan <-chan amqp.Delivery) {
+	for msg := range deliveryChan {
+		select {
+		case sub.deliveries <- fromAMQPDelivery(sub.queueName, msg):
+		case <-sub.sub.stop:
+			// Whatever is left is requeued when the channel is closed
+			return
+		}
+	}
+	b.restartConsumer(conn, sub)
+}
+
+// restartConsumer consumes for sub on conn again, with exponential
+// backoff, until it works or conn goes away.
+func (b *AMQPBroker) restartConsumer(conn *amqp.Connection, sub *amqpSubscription) {
+	backoff := b.config.InitialBackoff
+	for {
+		select {
+		case <-sub.sub.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		b.mu.Lock()
+		if sub.closed || b.closed || b.conn != conn || conn.IsClosed() {
+			// connect() resubscribes on the next connection
+			b.mu.Unlock()
+			return
+		}
+		err := b.consumeLocked(conn, sub)
+		b.mu.Unlock()
+		if err == nil {
+			return
+		}
+		logger().Warn("couldn't restart consumer", "queue", sub.queueName, "err", err)
+		backoff = nextBackoff(backoff, b.config.MaxBackoff)
+	}
+}
+
+func nextBackoff(current, max time.Duration) time.Duration {
+	next := current * 2
+	if next <= 0 {
+		next = 100 * time.Millisecond
+	}
+	if max > 0 && next > max {
+		next = max
+	}
+	return next
+}
+
+func toAMQPPublishing(msg Message) amqp.Publishing {
+	return amqp.Publishing{
+		ContentType:   msg.ContentType,
+		Headers:       amqp.Table(msg.Headers),
+		MessageId:     msg.MessageID,
+		CorrelationId: msg.CorrelationID,
+		Timestamp:     msg.Timestamp,
+		AppId:         msg.AppID,
+		ReplyTo:       msg.ReplyTo,
+		Priority:      msg.Priority,
+		Body:          msg.Body,
+	}
+}
+
+func fromAMQPDelivery(queueName string, msg amqp.Delivery) inbound {
+	return inbound{
+		Delivery: Delivery{
+			Message: Message{
+				ContentType:   msg.ContentType,
+				Body:          msg.Body,
+				Headers:       msg.Headers,
+				MessageID:     msg.MessageId,
+				CorrelationID: msg.CorrelationId,
+				Timestamp:     msg.Timestamp,
+				AppID:         msg.AppId,
+				ReplyTo:       msg.ReplyTo,
+				Priority:      msg.Priority,
+			},
+			Queue:       queueName,
+			Exchange:    msg.Exchange,
+			RoutingKey:  msg.RoutingKey,
+			Redelivered: msg.Redelivered,
+		},
+		ack:  func() error { return msg.Ack(false) },
+		nack: func(requeue bool) error { return msg.Nack(false, requeue) },
+	}
+}
+
+func DeclareAndBind(
+	conn *amqp.Connection,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+) (*amqp.Channel, amqp.Queue, error) {
+	queue := simpleQueueType.QueueOptions()
+	// Dead-letter to peril_dlx
+	queue.DeadLetterExchange = routing.ExchangePerilDeadLetter
+	return declareAndBind(conn, exchange, queueName, key, queue)
+}
+
+// DeclareAndBindWithOptions is DeclareAndBind for any queue QueueOptions
+// can describe. The options are validated first.
+func DeclareAndBindWithOptions(
+	conn *amqp.Connection,
+	exchange,
+	queueName,
+	key string,
+	queue QueueOptions,
+) (*amqp.Channel, amqp.Queue, error) {
+	if err := queue.Validate(); err != nil {
+		return nil, amqp.Queue{}, fmt.Errorf("invalid options for queue %s: %w", queueName, err)
+	}
+	return declareAndBind(conn, exchange, queueName, key, queue)
+}
+
+func declareAndBind(
+	conn *amqp.Connection,
+	exchange,
+	queueName,
+	key string,
+	options QueueOptions,
+) (*amqp.Channel, amqp.Queue, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, amqp.Queue{}, fmt.Errorf("couldn't create channel: %w", err)
+	}
+
+	queue, err := ch.QueueDeclare(
+		queueName,                  // name
+		options.Durable,            // durable
+		options.AutoDelete,         // delete when unused
+		options.Exclusive,          // exclusive
+		false,                      // no-wait
+		amqp.Table(options.Args()), // arguments
+	)
+	if err != nil {
+		ch.Close()
+		return nil, amqp.Queue{}, fmt.Errorf("couldn't declare queue: %w", err)
+	}
+
+	if exchange == "" {
+		// The default exchange can't be bound to, and routes by name anyway
+		return ch, queue, nil
+	}
+	err = ch.QueueBind(
+		queue.Name, // queue name
+		key,        // routing key
+		exchange,   // exchange
+		false,      // no-wait
+		nil,        // args
+	)
+	if err != nil {
+		ch.Close()
+		return nil, amqp.Queue{}, fmt.Errorf("couldn't bind queue: %w", err)
+	}
+
+	return ch, queue, nil
+}
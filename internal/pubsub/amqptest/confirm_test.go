@@ -0,0 +1,106 @@
+package amqptest_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub/amqptest"
+)
+
+// dialConfirming connects a broker in confirm mode to a server that
+// returns and confirms publishes as o says.
+func dialConfirming(t *testing.T, o amqptest.Options) *pubsub.AMQPBroker {
+	t.Helper()
+	s, certs := newServer(t, o)
+	url := strings.Replace(s.URL(), "amqps://", "amqps://guest:guest@", 1)
+	broker, err := dial(t, url, pubsub.TLSOptions{CAFile: certs.CAFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return broker
+}
+
+// is matches publishes with any of keys.
+func is(keys ...string) func(exchange, key string) bool {
+	return func(_, key string) bool {
+		for _, k := range keys {
+			if key == k {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestPublishConfirmed(t *testing.T) {
+	broker := dialConfirming(t, amqptest.Options{
+		Unroutable: is("nobody"),
+		Nacked:     is("refused"),
+	})
+	ctx := context.Background()
+
+	if err := pubsub.Publish(ctx, broker, "peril_topic", "army_moves.washington", "move", pubsub.WithMandatory()); err != nil {
+		t.Fatalf("routable publish: %v", err)
+	}
+	if err := pubsub.Publish(ctx, broker, "peril_topic", "nobody", "move"); err != nil {
+		t.Fatalf("unroutable publish that isn't mandatory: %v", err)
+	}
+
+	err := pubsub.Publish(ctx, broker, "peril_topic", "nobody", "move", pubsub.WithMandatory())
+	var unroutable *pubsub.UnroutableError
+	if !errors.As(err, &unroutable) || unroutable.RoutingKey != "nobody" || unroutable.Reason != "NO_ROUTE" {
+		t.Fatalf("mandatory unroutable publish returned %v, want NO_ROUTE for nobody", err)
+	}
+
+	if err := pubsub.Publish(ctx, broker, "peril_topic", "refused", "move"); !errors.Is(err, pubsub.ErrPublishNacked) {
+		t.Fatalf("nacked publish returned %v, want %v", err, pubsub.ErrPublishNacked)
+	}
+}
+
+func TestPublishBatchReturns(t *testing.T) {
+	broker := dialConfirming(t, amqptest.Options{Unroutable: is("nobody")})
+	msg := func(key string) pubsub.Envelope {
+		return pubsub.Envelope{Exchange: "peril_topic", Key: key, Message: pubsub.Message{
+			MessageID: pubsub.NewMessageID(),
+			Mandatory: true,
+		}}
+	}
+
+	errs := broker.PublishBatch(context.Background(), []pubsub.Envelope{msg("game_logs.washington"), msg("nobody"), msg("game_logs.lee"), msg("nobody")})
+	for i, err := range errs {
+		var unroutable *pubsub.UnroutableError
+		if wantReturned := i%2 == 1; errors.As(err, &unroutable) != wantReturned || !wantReturned && err != nil {
+			t.Errorf("message %d: got %v, returned: %v", i, err, wantReturned)
+		}
+	}
+}
+
+// TestLateReturn checks that returns of publishes that gave up waiting for
+// their confirm are neither blamed on later publishes nor left to block
+// the connection.
+func TestLateReturn(t *testing.T) {
+	broker := dialConfirming(t, amqptest.Options{
+		Unroutable:  is("lost"),
+		Unconfirmed: is("lost"),
+	})
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err := pubsub.Publish(ctx, broker, "peril_topic", "lost", "move", pubsub.WithMandatory())
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("publish without a confirm returned %v, want %v", err, context.DeadlineExceeded)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pubsub.Publish(ctx, broker, "peril_topic", "army_moves.washington", "move", pubsub.WithMandatory()); err != nil {
+		t.Fatalf("publish after returns of earlier ones: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package amqptest_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub/amqptest"
+)
+
+// eventually waits for cond to hold.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func dialReconnecting(t *testing.T, s *amqptest.TLSServer, certs amqptest.Certs, configure func(*pubsub.AMQPConfig)) *pubsub.AMQPBroker {
+	t.Helper()
+	url := strings.Replace(s.URL(), "amqps://", "amqps://guest:guest@", 1)
+	broker, err := dial(t, url, pubsub.TLSOptions{CAFile: certs.CAFile}, func(c *pubsub.AMQPConfig) {
+		c.InitialBackoff = 20 * time.Millisecond
+		c.MaxBackoff = 50 * time.Millisecond
+		if configure != nil {
+			configure(c)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return broker
+}
+
+func TestReconnectWithBrokenSubscription(t *testing.T) {
+	var refuse atomic.Bool
+	s, certs := newServer(t, amqptest.Options{
+		RefuseQueue: func(name string) bool { return refuse.Load() && name == "broken" },
+	})
+	broker := dialReconnecting(t, s, certs, nil)
+	for _, queue := range []string{"broken", "good"} {
+		_, err := broker.Subscribe(context.Background(), "peril_topic", queue, queue, pubsub.SimpleQueueDurable,
+			func(pubsub.Delivery) pubsub.AckType { return pubsub.Ack },
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	consumers := func(want string) func() bool {
+		return func() bool { return fmt.Sprint(s.Consumers()) == want }
+	}
+	eventually(t, "both consumers", consumers("[broken good]"))
+
+	// The broken queue can't be redeclared, which mustn't keep the rest
+	// of the broker down
+	refuse.Store(true)
+	s.DropConnections()
+	eventually(t, "a reconnect", func() bool { return len(s.Handshakes()) == 2 })
+	eventually(t, "the good consumer", consumers("[good]"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pubsub.Publish(ctx, broker, "peril_topic", "good", "move"); err != nil {
+		t.Fatalf("couldn't publish after reconnecting: %v", err)
+	}
+
+	refuse.Store(false)
+	eventually(t, "the broken consumer to come back", consumers("[broken good]"))
+}
+
+func TestReconnectFlushTimesOut(t *testing.T) {
+	s, certs := newServer(t, amqptest.Options{Unconfirmed: is("lost")})
+	broker := dialReconnecting(t, s, certs, func(c *pubsub.AMQPConfig) {
+		c.InitialBackoff = 200 * time.Millisecond
+		c.PublishTimeout = 100 * time.Millisecond
+		c.PublishBufferSize = 10
+	})
+
+	// Once the broker sees the connection is gone, publishes are buffered
+	// rather than left waiting for a confirm
+	s.DropConnections()
+	eventually(t, "a buffered publish", func() bool {
+		return pubsub.Publish(context.Background(), broker, "peril_topic", "lost", "move") == nil
+	})
+
+	eventually(t, "a reconnect", func() bool { return len(s.Handshakes()) == 2 })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pubsub.Publish(ctx, broker, "peril_topic", "army_moves.washington", "move"); err != nil {
+		t.Fatalf("buffered publish without a confirm held up the broker: %v", err)
+	}
+}
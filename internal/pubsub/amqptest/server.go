@@ -0,0 +1,621 @@
+// Package amqptest stands up a local TLS listener that speaks just enough
+// AMQP 0-9-1 for pubsub.DialAMQPBroker to connect and publish, so TLS and
+// SASL settings, publisher confirms and returns, and reconnects can be
+// exercised without a RabbitMQ.
+package amqptest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	frameMethod    = 1
+	frameHeader    = 2
+	frameBody      = 3
+	frameHeartbeat = 8
+	frameEnd       = 0xCE
+)
+
+// Reply codes the server closes connections with
+const (
+	replyNoRoute            = 312
+	replyAccessRefused      = 403
+	replyPreconditionFailed = 406
+	replyNotImplemented     = 540
+)
+
+var protocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+// Options configure what NewTLSServer accepts.
+type Options struct {
+	// RequireClientCert fails the TLS handshake unless the client presents
+	// a certificate signed by the CA.
+	RequireClientCert bool
+	// Users, when set, are the only usernames and passwords PLAIN accepts.
+	// EXTERNAL is accepted whenever the client presented a certificate.
+	Users map[string]string
+
+	// Unroutable reports the exchanges and keys no queue is bound for.
+	// Mandatory publishes to them are returned before they are confirmed,
+	// as RabbitMQ does.
+	Unroutable func(exchange, key string) bool
+	// Nacked reports the publishes to nack instead of ack.
+	Nacked func(exchange, key string) bool
+	// Unconfirmed reports the publishes never to confirm, as if the ack
+	// was lost.
+	Unconfirmed func(exchange, key string) bool
+	// RefuseQueue reports the queues whose declaration fails as
+	// inequivalent, the way RabbitMQ refuses to change a queue's arguments.
+	RefuseQueue func(name string) bool
+}
+
+// Handshake records how a client connected.
+type Handshake struct {
+	// ServerName is the SNI name the client asked for
+	ServerName string
+	// ClientCert is nil if the client didn't present one
+	ClientCert *x509.Certificate
+	Mechanism  string
+	Username   string
+	Password   string
+	Vhost      string
+}
+
+// TLSServer accepts amqps connections on 127.0.0.1.
+type TLSServer struct {
+	listener net.Listener
+	options  Options
+
+	mu         sync.Mutex
+	handshakes []Handshake
+	published  int
+	// consumers counts the consumers of each queue on open connections
+	consumers map[string]int
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+// NewTLSServer listens on a free port with the server certificate in certs,
+// trusting client certificates signed by its CA.
+func NewTLSServer(certs Certs, o Options) (*TLSServer, error) {
+	cert, err := tls.LoadX509KeyPair(certs.ServerCertFile, certs.ServerKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load server certificate: %w", err)
+	}
+	caPEM, err := os.ReadFile(certs.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if o.RequireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen: %w", err)
+	}
+	s := &TLSServer{
+		listener:  listener,
+		options:   o,
+		consumers: map[string]int{},
+		conns:     map[net.Conn]struct{}{},
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// URL is an amqps URL for the server's vhost "/" with no credentials.
+func (s *TLSServer) URL() string {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return "amqps://localhost:" + port + "/"
+}
+
+// Handshakes returns every connection that got as far as opening a vhost.
+func (s *TLSServer) Handshakes() []Handshake {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Handshake(nil), s.handshakes...)
+}
+
+// Published counts the messages clients have published.
+func (s *TLSServer) Published() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.published
+}
+
+// Consumers lists the queues being consumed on open connections, once per
+// consumer, in order.
+func (s *TLSServer) Consumers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var queues []string
+	for queue, n := range s.consumers {
+		for i := 0; i < n; i++ {
+			queues = append(queues, queue)
+		}
+	}
+	sort.Strings(queues)
+	return queues
+}
+
+// DropConnections closes every open connection without a word, as a
+// network failure would, and goes on listening for new ones.
+func (s *TLSServer) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Close stops listening and drops every open connection.
+func (s *TLSServer) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *TLSServer) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				conn.Close()
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+			}()
+			// Errors just end the connection; the client sees why
+			s.serve(conn.(*tls.Conn))
+		}()
+	}
+}
+
+type frame struct {
+	kind    byte
+	channel uint16
+	payload []byte
+}
+
+type wire struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+func (c *wire) read() (frame, error) {
+	var header [7]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return frame{}, err
+	}
+	f := frame{
+		kind:    header[0],
+		channel: binary.BigEndian.Uint16(header[1:3]),
+		payload: make([]byte, binary.BigEndian.Uint32(header[3:7])),
+	}
+	if _, err := io.ReadFull(c.r, f.payload); err != nil {
+		return frame{}, err
+	}
+	end, err := c.r.ReadByte()
+	if err != nil {
+		return frame{}, err
+	}
+	if end != frameEnd {
+		return frame{}, errors.New("frame has no end marker")
+	}
+	return f, nil
+}
+
+func (c *wire) write(kind byte, channel uint16, payload []byte) error {
+	var buf bytes.Buffer
+	buf.WriteByte(kind)
+	binary.Write(&buf, binary.BigEndian, channel)
+	binary.Write(&buf, binary.BigEndian, uint32(len(payload)))
+	buf.Write(payload)
+	buf.WriteByte(frameEnd)
+	_, err := c.w.Write(buf.Bytes())
+	return err
+}
+
+func (c *wire) method(channel uint16, class, method uint16, args ...any) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, class)
+	binary.Write(&buf, binary.BigEndian, method)
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case shortstr:
+			buf.WriteByte(byte(len(v)))
+			buf.WriteString(string(v))
+		case longstr:
+			binary.Write(&buf, binary.BigEndian, uint32(len(v)))
+			buf.WriteString(string(v))
+		default:
+			binary.Write(&buf, binary.BigEndian, v)
+		}
+	}
+	return c.write(frameMethod, channel, buf.Bytes())
+}
+
+// readMethod skips heartbeats and returns the next method frame.
+func (c *wire) readMethod() (frame, uint16, uint16, error) {
+	for {
+		f, err := c.read()
+		if err != nil {
+			return frame{}, 0, 0, err
+		}
+		if f.kind == frameHeartbeat {
+			continue
+		}
+		if f.kind != frameMethod || len(f.payload) < 4 {
+			return frame{}, 0, 0, fmt.Errorf("expected a method frame, got type %d", f.kind)
+		}
+		return f, binary.BigEndian.Uint16(f.payload[0:2]), binary.BigEndian.Uint16(f.payload[2:4]), nil
+	}
+}
+
+type shortstr string
+type longstr string
+
+// args reads the fields of a method frame in order.
+type args struct {
+	b   []byte
+	err error
+}
+
+func (a *args) take(n int) []byte {
+	if a.err != nil {
+		return nil
+	}
+	if len(a.b) < n {
+		a.err = errors.New("method frame too short")
+		return nil
+	}
+	v := a.b[:n]
+	a.b = a.b[n:]
+	return v
+}
+
+func (a *args) shortstr() string {
+	n := a.take(1)
+	if n == nil {
+		return ""
+	}
+	return string(a.take(int(n[0])))
+}
+
+func (a *args) longstr() string {
+	n := a.take(4)
+	if n == nil {
+		return ""
+	}
+	return string(a.take(int(binary.BigEndian.Uint32(n))))
+}
+
+func (s *TLSServer) serve(tc *tls.Conn) error {
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	state := tc.ConnectionState()
+	hs := Handshake{ServerName: state.ServerName}
+	if len(state.PeerCertificates) > 0 {
+		hs.ClientCert = state.PeerCertificates[0]
+	}
+
+	c := &wire{r: bufio.NewReader(tc), w: tc}
+	header := make([]byte, len(protocolHeader))
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header, protocolHeader) {
+		tc.Write(protocolHeader)
+		return errors.New("client doesn't speak AMQP 0-9-1")
+	}
+
+	// connection.start: version 0-9, no server properties
+	if err := c.method(0, 10, 10, uint8(0), uint8(9), uint32(0), longstr("PLAIN EXTERNAL"), longstr("en_US")); err != nil {
+		return err
+	}
+	f, class, method, err := c.readMethod()
+	if err != nil {
+		return err
+	}
+	if class != 10 || method != 11 {
+		return fmt.Errorf("expected connection.start-ok, got %d.%d", class, method)
+	}
+	a := &args{b: f.payload[4:]}
+	a.longstr() // client properties
+	hs.Mechanism = a.shortstr()
+	response := a.longstr()
+	if a.err != nil {
+		return a.err
+	}
+	if refused := s.authenticate(&hs, response); refused != "" {
+		return c.method(0, 10, 50, uint16(replyAccessRefused), shortstr("ACCESS_REFUSED - "+refused), uint16(0), uint16(0))
+	}
+
+	// connection.tune: channel-max, frame-max, no heartbeat of our own
+	if err := c.method(0, 10, 30, uint16(2047), uint32(131072), uint16(0)); err != nil {
+		return err
+	}
+	if _, _, _, err := c.readMethod(); err != nil { // tune-ok
+		return err
+	}
+	f, class, method, err = c.readMethod()
+	if err != nil {
+		return err
+	}
+	if class != 10 || method != 40 {
+		return fmt.Errorf("expected connection.open, got %d.%d", class, method)
+	}
+	a = &args{b: f.payload[4:]}
+	hs.Vhost = a.shortstr()
+	s.mu.Lock()
+	s.handshakes = append(s.handshakes, hs)
+	s.mu.Unlock()
+	if err := c.method(0, 10, 41, shortstr("")); err != nil {
+		return err
+	}
+
+	return s.session(c)
+}
+
+// authenticate checks the SASL response and returns why it was refused, or
+// "" if it wasn't.
+func (s *TLSServer) authenticate(hs *Handshake, response string) string {
+	switch hs.Mechanism {
+	case "PLAIN":
+		// \x00username\x00password
+		parts := strings.SplitN(response, "\x00", 3)
+		if len(parts) != 3 {
+			return "malformed PLAIN response"
+		}
+		hs.Username, hs.Password = parts[1], parts[2]
+		if s.options.Users != nil && (s.options.Users[hs.Username] != hs.Password || hs.Password == "") {
+			return "wrong username or password"
+		}
+	case "EXTERNAL":
+		if hs.ClientCert == nil {
+			return "EXTERNAL needs a client certificate"
+		}
+		hs.Username = hs.ClientCert.Subject.CommonName
+	default:
+		return "unsupported mechanism " + hs.Mechanism
+	}
+	return ""
+}
+
+// publish is a message coming in on a channel.
+type publish struct {
+	exchange  string
+	key       string
+	mandatory bool
+	header    []byte
+	body      []byte
+	// bodyLeft counts body bytes still to come
+	bodyLeft uint64
+}
+
+// session answers channel.open, confirm.select and basic.publish,
+// returning and confirming publishes as the options say. Queues can be
+// declared, bound and consumed from, though nothing is ever delivered.
+// Anything else closes the connection as not implemented.
+func (s *TLSServer) session(c *wire) error {
+	confirming := map[uint16]bool{}
+	published := map[uint16]uint64{}
+	publishing := map[uint16]*publish{}
+	// consuming maps each channel's consumer tags to their queues
+	consuming := map[uint16]map[string]string{}
+	stopConsuming := func(channel uint16, tag string) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for t, queue := range consuming[channel] {
+			if tag == "" || t == tag {
+				s.consumers[queue]--
+				if s.consumers[queue] == 0 {
+					delete(s.consumers, queue)
+				}
+				delete(consuming[channel], t)
+			}
+		}
+	}
+	defer func() {
+		for channel := range consuming {
+			stopConsuming(channel, "")
+		}
+	}()
+
+	for {
+		f, err := c.read()
+		if err != nil {
+			return err
+		}
+		switch f.kind {
+		case frameHeartbeat:
+			if err := c.write(frameHeartbeat, 0, nil); err != nil {
+				return err
+			}
+			continue
+		case frameHeader:
+			p := publishing[f.channel]
+			if p == nil || len(f.payload) < 12 {
+				return errors.New("unexpected content header")
+			}
+			p.header = f.payload
+			p.bodyLeft = binary.BigEndian.Uint64(f.payload[4:12])
+		case frameBody:
+			p := publishing[f.channel]
+			if p == nil {
+				return errors.New("unexpected content body")
+			}
+			p.body = append(p.body, f.payload...)
+			p.bodyLeft -= uint64(len(f.payload))
+		case frameMethod:
+			class := binary.BigEndian.Uint16(f.payload[0:2])
+			method := binary.BigEndian.Uint16(f.payload[2:4])
+			switch {
+			case class == 20 && method == 10: // channel.open
+				err = c.method(f.channel, 20, 11, longstr(""))
+			case class == 20 && method == 40: // channel.close
+				delete(confirming, f.channel)
+				delete(published, f.channel)
+				stopConsuming(f.channel, "")
+				err = c.method(f.channel, 20, 41)
+			case class == 20 && method == 41: // channel.close-ok
+				continue
+			case class == 50 && method == 10: // queue.declare
+				a := &args{b: f.payload[4:]}
+				a.take(2) // reserved
+				queue := a.shortstr()
+				if a.err != nil {
+					return a.err
+				}
+				if s.options.RefuseQueue != nil && s.options.RefuseQueue(queue) {
+					// channel.close, naming queue.declare as the cause
+					err = c.method(f.channel, 20, 40, uint16(replyPreconditionFailed), shortstr("PRECONDITION_FAILED - inequivalent arg for queue '"+queue+"'"), uint16(50), uint16(10))
+					break
+				}
+				// queue.declare-ok: no messages, no consumers
+				err = c.method(f.channel, 50, 11, shortstr(queue), uint32(0), uint32(0))
+			case class == 50 && method == 20: // queue.bind
+				err = c.method(f.channel, 50, 21)
+			case class == 60 && method == 10: // basic.qos
+				err = c.method(f.channel, 60, 11)
+			case class == 60 && method == 20: // basic.consume
+				a := &args{b: f.payload[4:]}
+				a.take(2) // reserved
+				queue, tag := a.shortstr(), a.shortstr()
+				if a.err != nil {
+					return a.err
+				}
+				if consuming[f.channel] == nil {
+					consuming[f.channel] = map[string]string{}
+				}
+				consuming[f.channel][tag] = queue
+				s.mu.Lock()
+				s.consumers[queue]++
+				s.mu.Unlock()
+				err = c.method(f.channel, 60, 21, shortstr(tag))
+			case class == 60 && method == 30: // basic.cancel
+				a := &args{b: f.payload[4:]}
+				tag := a.shortstr()
+				if a.err != nil {
+					return a.err
+				}
+				stopConsuming(f.channel, tag)
+				err = c.method(f.channel, 60, 31, shortstr(tag))
+			case class == 85 && method == 10: // confirm.select
+				confirming[f.channel] = true
+				if len(f.payload) > 4 && f.payload[4]&1 == 0 {
+					err = c.method(f.channel, 85, 11)
+				}
+			case class == 60 && method == 40: // basic.publish
+				a := &args{b: f.payload[4:]}
+				a.take(2) // reserved
+				p := &publish{exchange: a.shortstr(), key: a.shortstr()}
+				if bits := a.take(1); bits != nil {
+					p.mandatory = bits[0]&1 != 0
+				}
+				if a.err != nil {
+					return a.err
+				}
+				publishing[f.channel] = p
+				continue
+			case class == 10 && method == 50: // connection.close
+				return c.method(0, 10, 51)
+			default:
+				return c.method(0, 10, 50, uint16(replyNotImplemented), shortstr(fmt.Sprintf("NOT_IMPLEMENTED - method %d.%d", class, method)), class, method)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		p := publishing[f.channel]
+		if p.bodyLeft > 0 {
+			continue
+		}
+		delete(publishing, f.channel)
+		s.mu.Lock()
+		s.published++
+		s.mu.Unlock()
+		if err := s.settle(c, f.channel, p, confirming[f.channel], published); err != nil {
+			return err
+		}
+	}
+}
+
+// settle returns a complete publish if it can't be routed, then confirms
+// it if the channel is in confirm mode.
+func (s *TLSServer) settle(c *wire, channel uint16, p *publish, confirming bool, published map[uint16]uint64) error {
+	matches := func(f func(exchange, key string) bool) bool {
+		return f != nil && f(p.exchange, p.key)
+	}
+	if p.mandatory && matches(s.options.Unroutable) {
+		// basic.return, followed by the message as it came in
+		if err := c.method(channel, 60, 50, uint16(replyNoRoute), shortstr("NO_ROUTE"), shortstr(p.exchange), shortstr(p.key)); err != nil {
+			return err
+		}
+		if err := c.write(frameHeader, channel, p.header); err != nil {
+			return err
+		}
+		if len(p.body) > 0 {
+			if err := c.write(frameBody, channel, p.body); err != nil {
+				return err
+			}
+		}
+	}
+	if !confirming {
+		return nil
+	}
+
+	published[channel]++
+	tag := published[channel]
+	switch {
+	case matches(s.options.Unconfirmed):
+		return nil
+	case matches(s.options.Nacked):
+		// basic.nack: delivery tag, neither multiple nor requeue
+		return c.method(channel, 60, 120, tag, uint8(0))
+	default:
+		// basic.ack: delivery tag, not multiple
+		return c.method(channel, 60, 80, tag, uint8(0))
+	}
+}
@@ -0,0 +1,148 @@
+package amqptest_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub/amqptest"
+)
+
+func newServer(t *testing.T, o amqptest.Options) (*amqptest.TLSServer, amqptest.Certs) {
+	t.Helper()
+	certs, err := amqptest.NewCerts(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := amqptest.NewTLSServer(certs, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, certs
+}
+
+func dial(t *testing.T, url string, tlsOptions pubsub.TLSOptions, configure func(*pubsub.AMQPConfig)) (*pubsub.AMQPBroker, error) {
+	t.Helper()
+	config := pubsub.DefaultAMQPConfig()
+	config.Metrics = nil
+	tlsConfig, err := tlsOptions.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.TLS = tlsConfig
+	if configure != nil {
+		configure(&config)
+	}
+	return pubsub.DialAMQPBroker(url, config)
+}
+
+func TestPlainOverTLS(t *testing.T) {
+	s, certs := newServer(t, amqptest.Options{Users: map[string]string{"peril": "secret"}})
+	url := strings.Replace(s.URL(), "amqps://", "amqps://peril:secret@", 1)
+	broker, err := dial(t, url, pubsub.TLSOptions{CAFile: certs.CAFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	if err := pubsub.Publish(context.Background(), broker, "peril_direct", "pause", struct{}{}); err != nil {
+		t.Fatalf("publish wasn't confirmed: %v", err)
+	}
+	if n := s.Published(); n != 1 {
+		t.Fatalf("server saw %d publishes, want 1", n)
+	}
+
+	hs := s.Handshakes()
+	if len(hs) != 1 {
+		t.Fatalf("server saw %d handshakes, want 1", len(hs))
+	}
+	want := amqptest.Handshake{ServerName: "localhost", Mechanism: "PLAIN", Username: "peril", Password: "secret", Vhost: "/"}
+	if hs[0] != want {
+		t.Fatalf("handshake = %+v, want %+v", hs[0], want)
+	}
+}
+
+func TestPlainCredentialsReplaceURL(t *testing.T) {
+	s, certs := newServer(t, amqptest.Options{Users: map[string]string{"peril": "secret"}})
+	broker, err := dial(t, s.URL(), pubsub.TLSOptions{CAFile: certs.CAFile}, func(c *pubsub.AMQPConfig) {
+		c.Credentials = &pubsub.Credentials{Username: "peril", Password: "secret"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.Close()
+
+	if hs := s.Handshakes(); len(hs) != 1 || hs[0].Username != "peril" {
+		t.Fatalf("handshakes = %+v, want one as peril", hs)
+	}
+}
+
+func TestPlainRefused(t *testing.T) {
+	s, certs := newServer(t, amqptest.Options{Users: map[string]string{"peril": "secret"}})
+	url := strings.Replace(s.URL(), "amqps://", "amqps://peril:wrong@", 1)
+	if broker, err := dial(t, url, pubsub.TLSOptions{CAFile: certs.CAFile}, nil); err == nil {
+		broker.Close()
+		t.Fatal("connected with the wrong password")
+	}
+	if hs := s.Handshakes(); len(hs) != 0 {
+		t.Fatalf("server opened a vhost for %+v", hs)
+	}
+}
+
+func TestExternalAuth(t *testing.T) {
+	s, certs := newServer(t, amqptest.Options{RequireClientCert: true})
+	tlsOptions := pubsub.TLSOptions{
+		CAFile:   certs.CAFile,
+		CertFile: certs.ClientCertFile,
+		KeyFile:  certs.ClientKeyFile,
+	}
+	broker, err := dial(t, s.URL(), tlsOptions, func(c *pubsub.AMQPConfig) {
+		c.ExternalAuth = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	hs := s.Handshakes()
+	if len(hs) != 1 {
+		t.Fatalf("server saw %d handshakes, want 1", len(hs))
+	}
+	if hs[0].Mechanism != "EXTERNAL" || hs[0].Username != amqptest.ClientCommonName || hs[0].Password != "" {
+		t.Fatalf("handshake = %+v, want EXTERNAL as %s", hs[0], amqptest.ClientCommonName)
+	}
+	if hs[0].ClientCert == nil || hs[0].ClientCert.Subject.CommonName != amqptest.ClientCommonName {
+		t.Fatal("server didn't get the client certificate")
+	}
+}
+
+func TestClientCertRequired(t *testing.T) {
+	s, certs := newServer(t, amqptest.Options{RequireClientCert: true})
+	if broker, err := dial(t, s.URL(), pubsub.TLSOptions{CAFile: certs.CAFile}, func(c *pubsub.AMQPConfig) {
+		c.ExternalAuth = true
+	}); err == nil {
+		broker.Close()
+		t.Fatal("connected without a client certificate")
+	}
+}
+
+func TestUntrustedServer(t *testing.T) {
+	s, _ := newServer(t, amqptest.Options{})
+	// The system roots don't include the test CA
+	url := strings.Replace(s.URL(), "amqps://", "amqps://guest:guest@", 1)
+	if broker, err := dial(t, url, pubsub.TLSOptions{}, nil); err == nil {
+		broker.Close()
+		t.Fatal("trusted a server certificate from an unknown CA")
+	}
+}
+
+func TestServerNameChecked(t *testing.T) {
+	s, certs := newServer(t, amqptest.Options{})
+	url := strings.Replace(s.URL(), "amqps://", "amqps://guest:guest@", 1)
+	if broker, err := dial(t, url, pubsub.TLSOptions{CAFile: certs.CAFile, ServerName: "rabbit.example.com"}, nil); err == nil {
+		broker.Close()
+		t.Fatal("accepted a certificate for another name")
+	}
+}
@@ -0,0 +1,142 @@
+package pubsub
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// appendLogSlack is how many more lines than live records an append log
+// may hold before its owner should rewrite it.
+const appendLogSlack = 1024
+
+// appendLog is a file of JSON records, one per line, that is only ever
+// appended to. Its owner replays it with readAppendLog when opening it, then
+// rewrites it with just the records that still matter, and again whenever
+// it has grown well past them.
+type appendLog struct {
+	path string
+	// name says what the log holds in error messages
+	name string
+	file *os.File
+	// lines counts the records in the file
+	lines int
+}
+
+// readAppendLog calls fn with each record in the log at path, if there is
+// one. Lines that don't decode are skipped.
+func readAppendLog[R any](path, name string, fn func(R)) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't open %s: %w", name, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// Records can be far longer than the default line limit
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var record R
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// Most likely a write cut short by a crash
+			continue
+		}
+		fn(record)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("couldn't read %s: %w", name, err)
+	}
+	return nil
+}
+
+// createAppendLog replaces the log at path with records and opens it for
+// appending. The new file only takes the old one's place once it is
+// complete, so a crash part way leaves the old one intact.
+func createAppendLog(path, name string, records []any) (*appendLog, error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't compact %s: %w", name, err)
+	}
+	fail := func(err error) (*appendLog, error) {
+		f.Close()
+		return nil, fmt.Errorf("couldn't compact %s: %w", name, err)
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			return fail(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fail(err)
+	}
+	// The rename itself is only durable once the directory is synced
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return fail(err)
+	}
+	return &appendLog{path: path, name: name, file: f, lines: len(records)}, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// needsRewrite reports whether the log has grown well past live records.
+func (l *appendLog) needsRewrite(live int) bool {
+	return l.lines > 2*live+appendLogSlack
+}
+
+// rewrite replaces the log's contents with records.
+func (l *appendLog) rewrite(records []any) error {
+	next, err := createAppendLog(l.path, l.name, records)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	*l = *next
+	return nil
+}
+
+// append writes record at the end of the log, and with sync makes sure it
+// is on disk before returning.
+func (l *appendLog) append(record any, sync bool) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("couldn't encode %s record: %w", l.name, err)
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("couldn't write %s: %w", l.name, err)
+	}
+	l.lines++
+	if sync {
+		if err := l.file.Sync(); err != nil {
+			return fmt.Errorf("couldn't sync %s: %w", l.name, err)
+		}
+	}
+	return nil
+}
+
+func (l *appendLog) close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,230 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/tracing"
+)
+
+var errBatcherClosed = errors.New("batcher is closed")
+
+// BatchConfig decides when a Batcher publishes what it has collected. A
+// batch goes as soon as any limit is reached.
+type BatchConfig struct {
+	MaxMessages int
+	// MaxBytes counts message bodies only
+	MaxBytes int
+	// Linger is how long the first message of a batch waits for more to
+	// join it. Zero waits until MaxMessages, MaxBytes or Flush.
+	Linger time.Duration
+}
+
+func DefaultBatchConfig() BatchConfig {
+	return BatchConfig{
+		MaxMessages: 100,
+		MaxBytes:    1 << 20,
+		Linger:      5 * time.Millisecond,
+	}
+}
+
+// Future is the result of a message published through a Batcher.
+type Future struct {
+	done chan struct{}
+	err  error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+func (f *Future) complete(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// Done is closed once the message has been published or has failed.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err is the result of publishing the message, valid once Done is closed.
+func (f *Future) Err() error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the message has been published and returns the
+// result, or returns ctx's error if it is done first.
+func (f *Future) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Batcher collects messages and publishes them in batches, so a stream of
+// messages waits for one confirm per batch instead of one per message.
+// Publishers that implement BatchPublisher get the whole batch at once;
+// others are given its messages one at a time. Batches are published in
+// order, one at a time, and Add blocks while a full batch waits for the
+// one before it.
+type Batcher struct {
+	pub     Publisher
+	config  BatchConfig
+	batches chan []batchEntry
+	done    chan struct{}
+
+	mu      sync.Mutex
+	pending []batchEntry
+	bytes   int
+	timer   *time.Timer
+	closed  bool
+}
+
+type batchEntry struct {
+	msg    Envelope
+	future *Future
+	// span, if set, ends when the message has been published
+	span *tracing.Span
+}
+
+func NewBatcher(pub Publisher, config BatchConfig) *Batcher {
+	b := &Batcher{
+		pub:     pub,
+		config:  config,
+		batches: make(chan []batchEntry),
+		done:    make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Add queues msg for publishing to exchange with key in the next batch.
+func (b *Batcher) Add(exchange, key string, msg Message) *Future {
+	return b.add(batchEntry{
+		msg:    Envelope{Exchange: exchange, Key: key, Message: msg},
+		future: newFuture(),
+	})
+}
+
+// PublishBatched encodes val the way Publish does and adds it to the next
+// batch. Encoding and rate limit failures come back through the future.
+func PublishBatched[T any](ctx context.Context, b *Batcher, exchange, key string, val T, opts ...PublishOption) *Future {
+	msg, err := newMessage(ctx, val, opts)
+	if err != nil {
+		f := newFuture()
+		f.complete(err)
+		return f
+	}
+
+	_, span := startPublishSpan(ctx, exchange+" publish", exchange, key, &msg)
+	return b.add(batchEntry{
+		msg:    Envelope{Exchange: exchange, Key: key, Message: msg},
+		future: newFuture(),
+		span:   span,
+	})
+}
+
+func (b *Batcher) add(entry batchEntry) *Future {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		b.finish(entry, errBatcherClosed)
+		return entry.future
+	}
+
+	b.pending = append(b.pending, entry)
+	b.bytes += len(entry.msg.Message.Body)
+	full := (b.config.MaxMessages > 0 && len(b.pending) >= b.config.MaxMessages) ||
+		(b.config.MaxBytes > 0 && b.bytes >= b.config.MaxBytes)
+	switch {
+	case full:
+		b.flushLocked()
+	case len(b.pending) == 1 && b.config.Linger > 0:
+		b.timer = time.AfterFunc(b.config.Linger, b.Flush)
+	}
+	return entry.future
+}
+
+// Flush publishes what has been collected without waiting for the batch to
+// fill up or linger.
+func (b *Batcher) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.flushLocked()
+	}
+}
+
+func (b *Batcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.pending) == 0 {
+		return
+	}
+	b.batches <- b.pending
+	b.pending = nil
+	b.bytes = 0
+}
+
+// Close publishes what has been collected and waits for every batch to
+// finish. Messages added afterwards fail.
+func (b *Batcher) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.flushLocked()
+	b.closed = true
+	close(b.batches)
+	b.mu.Unlock()
+
+	<-b.done
+	return nil
+}
+
+func (b *Batcher) run() {
+	defer close(b.done)
+	for batch := range b.batches {
+		msgs := make([]Envelope, len(batch))
+		for i, entry := range batch {
+			msgs[i] = entry.msg
+		}
+		errs := b.publish(msgs)
+		for i, entry := range batch {
+			b.finish(entry, errs[i])
+		}
+	}
+}
+
+func (b *Batcher) publish(msgs []Envelope) []error {
+	ctx := context.Background()
+	if bp, ok := b.pub.(BatchPublisher); ok {
+		return bp.PublishBatch(ctx, msgs)
+	}
+	errs := make([]error, len(msgs))
+	for i, m := range msgs {
+		errs[i] = b.pub.Publish(ctx, m.Exchange, m.Key, m.Message)
+	}
+	return errs
+}
+
+func (b *Batcher) finish(entry batchEntry, err error) {
+	if entry.span != nil {
+		entry.span.RecordError(err)
+		entry.span.End()
+	}
+	entry.future.complete(err)
+}
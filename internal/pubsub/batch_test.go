@@ -0,0 +1,211 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingPublisher records what it is given and fails with err, if set.
+type recordingPublisher struct {
+	mu   sync.Mutex
+	msgs []Envelope
+	err  error
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.msgs = append(p.msgs, Envelope{Exchange: exchange, Key: key, Message: msg})
+	return p.err
+}
+
+func (p *recordingPublisher) published() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.msgs)
+}
+
+func waitFuture(t *testing.T, f *Future) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := f.Wait(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("future wasn't resolved")
+	}
+	return err
+}
+
+func TestBatcherResolvesOnFlush(t *testing.T) {
+	pub := &recordingPublisher{}
+	b := NewBatcher(pub, BatchConfig{})
+	defer b.Close()
+
+	futures := []*Future{
+		b.Add("ex", "a", Message{Body: []byte("1")}),
+		b.Add("ex", "b", Message{Body: []byte("2")}),
+	}
+	time.Sleep(20 * time.Millisecond)
+	for _, f := range futures {
+		select {
+		case <-f.Done():
+			t.Fatal("future resolved before the batch was flushed")
+		default:
+		}
+	}
+
+	b.Flush()
+	for _, f := range futures {
+		if err := waitFuture(t, f); err != nil {
+			t.Fatalf("future resolved with %v, want nil", err)
+		}
+	}
+	if n := pub.published(); n != 2 {
+		t.Fatalf("published %d messages, want 2", n)
+	}
+}
+
+func TestBatcherResolvesWhenFull(t *testing.T) {
+	pub := &recordingPublisher{}
+	b := NewBatcher(pub, BatchConfig{MaxMessages: 3})
+	defer b.Close()
+
+	var futures []*Future
+	for i := 0; i < 3; i++ {
+		futures = append(futures, b.Add("ex", "k", Message{}))
+	}
+	for _, f := range futures {
+		if err := waitFuture(t, f); err != nil {
+			t.Fatalf("future resolved with %v, want nil", err)
+		}
+	}
+}
+
+func TestBatcherResolvesAfterLinger(t *testing.T) {
+	pub := &recordingPublisher{}
+	b := NewBatcher(pub, BatchConfig{MaxMessages: 100, Linger: 10 * time.Millisecond})
+	defer b.Close()
+
+	start := time.Now()
+	f := b.Add("ex", "k", Message{})
+	if err := waitFuture(t, f); err != nil {
+		t.Fatalf("future resolved with %v, want nil", err)
+	}
+	if waited := time.Since(start); waited < 10*time.Millisecond {
+		t.Fatalf("batch went after %s, before lingering", waited)
+	}
+}
+
+func TestBatcherResolvesWithPublishError(t *testing.T) {
+	errDown := errors.New("broker is down")
+	pub := &recordingPublisher{err: errDown}
+	b := NewBatcher(pub, BatchConfig{Linger: time.Millisecond})
+	defer b.Close()
+
+	futures := []*Future{b.Add("ex", "a", Message{}), b.Add("ex", "b", Message{})}
+	for _, f := range futures {
+		if err := waitFuture(t, f); !errors.Is(err, errDown) {
+			t.Fatalf("future resolved with %v, want %v", err, errDown)
+		}
+		if err := f.Err(); !errors.Is(err, errDown) {
+			t.Fatalf("Err() = %v, want %v", err, errDown)
+		}
+	}
+}
+
+func TestBatcherResolvesEachBatchError(t *testing.T) {
+	broker := NewMemoryBroker()
+	broker.SetMetrics(nil)
+	defer broker.Close()
+	if err := broker.DeclareExchange("ex", ExchangeKindDirect); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBatcher(broker, BatchConfig{MaxMessages: 2})
+	defer b.Close()
+
+	ok := b.Add("ex", "k", Message{})
+	missing := b.Add("no_such_exchange", "k", Message{})
+	if err := waitFuture(t, ok); err != nil {
+		t.Fatalf("future resolved with %v, want nil", err)
+	}
+	if err := waitFuture(t, missing); err == nil {
+		t.Fatal("publishing to a missing exchange resolved without an error")
+	}
+}
+
+func TestBatcherFailsAfterClose(t *testing.T) {
+	pub := &recordingPublisher{}
+	b := NewBatcher(pub, BatchConfig{})
+	pending := b.Add("ex", "k", Message{})
+	b.Close()
+
+	if err := waitFuture(t, pending); err != nil {
+		t.Fatalf("message added before Close resolved with %v, want nil", err)
+	}
+	if err := waitFuture(t, b.Add("ex", "k", Message{})); !errors.Is(err, errBatcherClosed) {
+		t.Fatalf("message added after Close resolved with %v, want %v", err, errBatcherClosed)
+	}
+}
+
+func TestPublishBatchedResolvesEncodeError(t *testing.T) {
+	b := NewBatcher(&recordingPublisher{}, BatchConfig{})
+	defer b.Close()
+
+	f := PublishBatched(context.Background(), b, "ex", "k", func() {})
+	if err := waitFuture(t, f); err == nil {
+		t.Fatal("publishing a func resolved without an error")
+	}
+}
+
+type benchMove struct {
+	Player string `json:"player"`
+	Units  []int  `json:"units"`
+}
+
+func newBenchBroker(b *testing.B) *MemoryBroker {
+	broker := NewMemoryBroker()
+	broker.SetMetrics(nil)
+	b.Cleanup(func() { broker.Close() })
+	if err := broker.DeclareExchange("bench", ExchangeKindTopic); err != nil {
+		b.Fatal(err)
+	}
+	return broker
+}
+
+func BenchmarkPublish(b *testing.B) {
+	broker := newBenchBroker(b)
+	ctx := context.Background()
+	move := benchMove{Player: "washington", Units: []int{1, 2, 3}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := Publish(ctx, broker, "bench", "army_moves.washington", move); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPublishBatched(b *testing.B) {
+	broker := newBenchBroker(b)
+	batcher := NewBatcher(broker, DefaultBatchConfig())
+	defer batcher.Close()
+	ctx := context.Background()
+	move := benchMove{Player: "washington", Units: []int{1, 2, 3}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	futures := make([]*Future, b.N)
+	for i := 0; i < b.N; i++ {
+		futures[i] = PublishBatched(ctx, batcher, "bench", "army_moves.washington", move)
+	}
+	batcher.Flush()
+	for _, f := range futures {
+		if err := f.Wait(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNotFound     = errors.New("not found on broker")
+	ErrInequivalent = errors.New("exists on broker with different properties")
+	ErrCannotVerify = errors.New("can't be verified on this broker")
+)
+
+type ExchangeKind string
+
+const (
+	ExchangeKindDirect ExchangeKind = "direct"
+	ExchangeKindTopic  ExchangeKind = "topic"
+	ExchangeKindFanout ExchangeKind = "fanout"
+)
+
+// Message is a broker-agnostic outgoing message.
+type Message struct {
+	ContentType   string
+	Body          []byte
+	Headers       map[string]any
+	MessageID     string
+	CorrelationID string
+	Timestamp     time.Time
+	AppID         string
+	// ReplyTo names the queue a response should be sent to
+	ReplyTo string
+	// Priority puts the message ahead of lower priority ones in queues
+	// declared with a maximum priority. Other queues ignore it.
+	Priority uint8
+	// Mandatory asks the broker to report the message as unroutable with an
+	// *UnroutableError instead of silently dropping it.
+	Mandatory bool
+}
+
+// Envelope is a message together with where it is to be published.
+type Envelope struct {
+	Exchange string  `json:"exchange"`
+	Key      string  `json:"key"`
+	Message  Message `json:"message"`
+}
+
+// UnroutableError is returned by Publish for a mandatory message that no
+// queue was bound to receive.
+type UnroutableError struct {
+	Exchange   string
+	RoutingKey string
+	Reason     string
+}
+
+func (e *UnroutableError) Error() string {
+	return fmt.Sprintf("message to %s with key %s was not delivered: %s", e.Exchange, e.RoutingKey, e.Reason)
+}
+
+// Delivery is a message received from a queue.
+type Delivery struct {
+	Message
+	// Queue is the queue the message was consumed from
+	Queue       string
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
+
+	// ctx is done once the subscription handling the delivery is closing
+	ctx context.Context
+}
+
+// context is done once the subscription handling d is closing, so that
+// middleware waiting on something doesn't hold up Close.
+func (d Delivery) context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
+	}
+	return d.ctx
+}
+
+type Publisher interface {
+	Publish(ctx context.Context, exchange, key string, msg Message) error
+}
+
+// BatchPublisher publishes several messages at once, waiting for the
+// broker to confirm them together rather than one at a time. The result
+// for msgs[i] is errs[i].
+type BatchPublisher interface {
+	PublishBatch(ctx context.Context, msgs []Envelope) (errs []error)
+}
+
+// Subscriber consumes from a queue until ctx is cancelled or the returned
+// Subscription is closed. With an empty exchange the queue is left unbound,
+// since the default exchange already routes to it by name.
+type Subscriber interface {
+	Subscribe(
+		ctx context.Context,
+		exchange,
+		queueName,
+		key string,
+		simpleQueueType SimpleQueueType,
+		handler func(Delivery) AckType,
+		opts ...SubscribeOption,
+	) (*Subscription, error)
+}
+
+// Declarer creates exchanges, queues and bindings. Declaring something that
+// already exists with the same properties is a no-op.
+type Declarer interface {
+	DeclareExchange(name string, kind ExchangeKind) error
+	DeclareQueue(name string, simpleQueueType SimpleQueueType, args map[string]any) error
+	// DeclareQueueWithOptions declares the queue q describes, with args
+	// added to its arguments. q is validated before the broker is asked.
+	DeclareQueueWithOptions(name string, q QueueOptions, args map[string]any) error
+	BindQueue(queueName, key, exchange string) error
+}
+
+// Verifier checks what exists on the broker without changing it. Failures
+// wrap ErrNotFound, ErrInequivalent or ErrCannotVerify.
+type Verifier interface {
+	VerifyExchange(name string, kind ExchangeKind) error
+	VerifyQueue(name string, simpleQueueType SimpleQueueType, args map[string]any) error
+	VerifyQueueWithOptions(name string, q QueueOptions, args map[string]any) error
+	VerifyBinding(queueName, key, exchange string) error
+}
+
+// Broker is implemented by AMQPBroker (RabbitMQ) and MemoryBroker (in-process).
+type Broker interface {
+	Publisher
+	BatchPublisher
+	Subscriber
+	Declarer
+	Verifier
+	Inspector
+	Close() error
+}
@@ -0,0 +1,107 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Codec turns values into message bodies and back for one content type.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	JSON Codec = jsonCodec{}
+	Gob  Codec = gobCodec{}
+	CBOR Codec = cborCodec{}
+)
+
+// DefaultCodecs is what subscriptions decode with unless WithCodecs says
+// otherwise.
+var DefaultCodecs = NewCodecRegistry(JSON, Gob, CBOR)
+
+type CodecRegistry struct {
+	mu     sync.RWMutex
+	codecs map[string]Codec
+}
+
+func NewCodecRegistry(codecs ...Codec) *CodecRegistry {
+	r := &CodecRegistry{codecs: map[string]Codec{}}
+	for _, c := range codecs {
+		r.Register(c)
+	}
+	return r
+}
+
+func (r *CodecRegistry) Register(c Codec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.codecs[c.ContentType()] = c
+}
+
+// Lookup finds the codec for a Content-Type header, ignoring parameters
+// such as charset.
+func (r *CodecRegistry) Lookup(contentType string) (Codec, bool) {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.codecs[contentType]
+	return c, ok
+}
+
+// decode picks the codec by the delivery's Content-Type, falling back to
+// fallback (if any) for messages that don't have one.
+func decode[T any](codecs *CodecRegistry, fallback Codec, d Delivery) (T, error) {
+	var content T
+	codec, ok := codecs.Lookup(d.ContentType)
+	if !ok {
+		if d.ContentType != "" || fallback == nil {
+			return content, fmt.Errorf("no codec for content type %q", d.ContentType)
+		}
+		codec = fallback
+	}
+	err := codec.Unmarshal(d.Body, &content)
+	return content, err
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return "application/json" }
+
+func (jsonCodec) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return "application/gob" }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type cborCodec struct{}
+
+func (cborCodec) ContentType() string { return "application/cbor" }
+
+func (cborCodec) Marshal(v any) ([]byte, error) { return cbor.Marshal(v) }
+
+func (cborCodec) Unmarshal(data []byte, v any) error { return cbor.Unmarshal(data, v) }
@@ -0,0 +1,122 @@
+package pubsub
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestCodecLookup(t *testing.T) {
+	tests := map[string]Codec{
+		"application/json":                JSON,
+		"application/json; charset=utf-8": JSON,
+		"application/gob":                 Gob,
+		"application/cbor":                CBOR,
+		"text/plain":                      nil,
+		"":                                nil,
+	}
+	for contentType, want := range tests {
+		codec, ok := DefaultCodecs.Lookup(contentType)
+		if ok != (want != nil) || ok && codec != want {
+			t.Errorf("Lookup(%q) = %v, %t, want %v", contentType, codec, ok, want)
+		}
+	}
+}
+
+// publishEncoded publishes req to queue as codec encodes it, with
+// contentType as its Content-Type.
+func publishEncoded(t *testing.T, b *MemoryBroker, queue string, codec Codec, contentType string, req routing.JoinRequest) {
+	t.Helper()
+	body, err := codec.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := Message{ContentType: contentType, Body: body}
+	if err := b.Publish(context.Background(), routing.ExchangePerilDirect, queue, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func subscribeJoins(t *testing.T, b *MemoryBroker, queue string, opts ...SubscribeOption) <-chan routing.JoinRequest {
+	t.Helper()
+	joins := make(chan routing.JoinRequest, 10)
+	_, err := Subscribe(context.Background(), b, routing.ExchangePerilDirect, queue, queue, SimpleQueueDurable,
+		func(req routing.JoinRequest) AckType {
+			joins <- req
+			return Ack
+		},
+		opts...,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return joins
+}
+
+func TestDecodeByContentType(t *testing.T) {
+	b := newTestBroker(t)
+	joins := subscribeJoins(t, b, "joins", WithFallbackCodec(JSON))
+
+	publishEncoded(t, b, "joins", Gob, "application/gob", routing.JoinRequest{Username: "gob"})
+	publishEncoded(t, b, "joins", CBOR, "application/cbor", routing.JoinRequest{Username: "cbor"})
+	publishEncoded(t, b, "joins", JSON, "application/json; charset=utf-8", routing.JoinRequest{Username: "json"})
+	// Without a Content-Type the fallback decodes it
+	publishEncoded(t, b, "joins", JSON, "", routing.JoinRequest{Username: "fallback"})
+
+	for _, want := range []string{"gob", "cbor", "json", "fallback"} {
+		if got := receive(t, joins).Username; got != want {
+			t.Fatalf("decoded %q, want %q", got, want)
+		}
+	}
+}
+
+func TestDecodeWithCodecs(t *testing.T) {
+	b := newTestBroker(t)
+	bindDeadLetterQueue(t, b, routing.DeadLetterQueue, routing.ExchangePerilDeadLetter)
+	joins := subscribeJoins(t, b, "joins", WithCodecs(NewCodecRegistry(Gob)))
+
+	publishEncoded(t, b, "joins", JSON, "application/json", routing.JoinRequest{Username: "json"})
+	publishEncoded(t, b, "joins", Gob, "application/gob", routing.JoinRequest{Username: "gob"})
+
+	if got := receive(t, joins).Username; got != "gob" {
+		t.Fatalf("decoded %q, want gob", got)
+	}
+	waitForQueue(t, b, routing.DeadLetterQueue, 1)
+}
+
+func TestDecodeUnknownContentType(t *testing.T) {
+	b := newTestBroker(t)
+	bindDeadLetterQueue(t, b, routing.DeadLetterQueue, routing.ExchangePerilDeadLetter)
+	joins := subscribeJoins(t, b, "joins", WithFallbackCodec(JSON))
+
+	publishEncoded(t, b, "joins", JSON, "text/plain", routing.JoinRequest{Username: "text"})
+
+	dead := waitForQueue(t, b, routing.DeadLetterQueue, 1)
+	headers := dead[0].Headers
+	if headers[HeaderOriginalContentType] != "text/plain" || headers[HeaderOriginalQueue] != "joins" {
+		t.Fatalf("dead-lettered with headers %v", headers)
+	}
+	if reason, _ := headers[HeaderDecodeError].(string); !strings.Contains(reason, "text/plain") {
+		t.Fatalf("decode error = %q, want it to name the content type", reason)
+	}
+	select {
+	case req := <-joins:
+		t.Fatalf("handler got %+v", req)
+	default:
+	}
+}
+
+func TestDecodeWithoutContentTypeOrFallback(t *testing.T) {
+	b := newTestBroker(t)
+	bindDeadLetterQueue(t, b, routing.DeadLetterQueue, routing.ExchangePerilDeadLetter)
+	subscribeJoins(t, b, "joins", WithDecodeFailurePolicy(DecodeFailurePolicy{Action: DecodeFailureDiscard}))
+
+	publishEncoded(t, b, "joins", JSON, "", routing.JoinRequest{Username: "bare"})
+
+	time.Sleep(20 * time.Millisecond)
+	waitForQueue(t, b, "joins", 0)
+	waitForQueue(t, b, routing.DeadLetterQueue, 0)
+}
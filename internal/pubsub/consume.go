@@ -1,16 +1,30 @@
 package pubsub
 
 import (
-	"bytes"
-	"encoding/gob"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/tracing"
 )
 
-type AckType int
+// AckType tells the subscriber how to settle a message once its handler
+// returns. Compare it with ==; RetryAfter values carry their delay.
+type AckType struct {
+	kind  ackKind
+	delay time.Duration
+}
+
+type ackKind int
+
+const (
+	ackKindAck ackKind = iota
+	ackKindNackRequeue
+	ackKindNackDiscard
+	ackKindRetry
+)
 
 type SimpleQueueType int
 
@@ -19,157 +33,358 @@ const (
 	SimpleQueueTransient
 )
 
-const (
-	Ack AckType = iota
-	NackRequeue
-	NackDiscard
+var (
+	Ack         = AckType{kind: ackKindAck}
+	NackRequeue = AckType{kind: ackKindNackRequeue}
+	NackDiscard = AckType{kind: ackKindNackDiscard}
 )
 
-func SubscribeGob[T any](
-	conn *amqp.Connection,
+func (a AckType) String() string {
+	switch a.kind {
+	case ackKindAck:
+		return "ack"
+	case ackKindNackRequeue:
+		return "nack (requeue)"
+	case ackKindNackDiscard:
+		return "nack (discard)"
+	case ackKindRetry:
+		return fmt.Sprintf("retry after %s", a.delay)
+	default:
+		return "unknown"
+	}
+}
+
+// label names the kind of settlement for metrics.
+func (a AckType) label() string {
+	switch a.kind {
+	case ackKindAck:
+		return "ack"
+	case ackKindNackRequeue:
+		return "nack_requeue"
+	case ackKindNackDiscard:
+		return "nack_discard"
+	case ackKindRetry:
+		return "retry"
+	default:
+		return "unknown"
+	}
+}
+
+// RetryAfter hands the message back to its queue once delay has passed. See
+// RetryPolicy for how many times that can happen.
+func RetryAfter(delay time.Duration) AckType {
+	return AckType{kind: ackKindRetry, delay: delay}
+}
+
+const defaultPrefetchCount = 10
+
+type subscribeOptions struct {
+	prefetchCount int
+	prefetchSize  int
+	workers       int
+	// orderingKey, when set, routes every delivery with the same key to the
+	// same worker so they're handled in the order they arrived
+	orderingKey func(Delivery) string
+	// valueKey holds the func(T) string given to OrderByValue until
+	// subscribe[T] can turn it into an orderingKey
+	valueKey      any
+	decodeFailure DecodeFailurePolicy
+	retry         RetryPolicy
+	codecs        *CodecRegistry
+	fallbackCodec Codec
+	middleware    []Middleware
+	// deadLetterExchange is set on the queue as x-dead-letter-exchange
+	deadLetterExchange string
+	// deadLetterExchangeSet is whether WithDeadLetterExchange was given
+	deadLetterExchangeSet bool
+	// maxPriority, if set, is set on the queue as x-max-priority
+	maxPriority uint8
+	// queue, if set, replaces the queue the SimpleQueueType stands for
+	queue *QueueOptions
+}
+
+type SubscribeOption func(*subscribeOptions)
+
+func newSubscribeOptions(opts []SubscribeOption) subscribeOptions {
+	o := subscribeOptions{
+		prefetchCount: defaultPrefetchCount,
+		workers:       1,
+		decodeFailure: DefaultDecodeFailurePolicy(),
+		retry:         DefaultRetryPolicy(),
+		codecs:        DefaultCodecs,
+
+		deadLetterExchange: routing.ExchangePerilDeadLetter,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.queue != nil {
+		// Undecodable messages go wherever the queue dead-letters to, so
+		// whichever of the two was given decides for both
+		switch {
+		case !o.deadLetterExchangeSet:
+			o.deadLetterExchange = o.queue.DeadLetterExchange
+		case o.queue.DeadLetterExchange == "" && o.queue.DeadLetterRoutingKey == "":
+			o.queue.DeadLetterExchange = o.deadLetterExchange
+		}
+	}
+	return o
+}
+
+// WithPrefetch limits how many messages (count) and bytes (size) the broker
+// sends ahead of acknowledgements. Zero means no limit.
+func WithPrefetch(count, size int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.prefetchCount = count
+		o.prefetchSize = size
+	}
+}
+
+// WithWorkers runs n handlers concurrently. Without an ordering key messages
+// may be handled in any order; keep the prefetch count at least n so every
+// worker has something to do.
+func WithWorkers(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		if n > 0 {
+			o.workers = n
+		}
+	}
+}
+
+// OrderBy keeps deliveries that share a key in order across workers.
+func OrderBy(key func(Delivery) string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.orderingKey = key
+	}
+}
+
+func OrderByRoutingKey() SubscribeOption {
+	return OrderBy(func(d Delivery) string {
+		return d.RoutingKey
+	})
+}
+
+// OrderByValue keeps messages in order by a key taken from the decoded
+// message. It only works with the typed Subscribe* helpers, and the body is
+// decoded once more to compute the key.
+func OrderByValue[T any](key func(T) string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.valueKey = key
+	}
+}
+
+// WithDeadLetterExchange replaces peril_dlx as the exchange the queue
+// dead-letters to, and where undecodable messages go unless the decode
+// failure policy names another.
+func WithDeadLetterExchange(exchange string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.deadLetterExchange = exchange
+		o.deadLetterExchangeSet = true
+	}
+}
+
+// WithMaxPriority declares the queue as a priority queue, where messages
+// published with a higher priority, up to max, are delivered first. The
+// broker refuses to change this on a queue that already exists.
+func WithMaxPriority(max uint8) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.maxPriority = max
+	}
+}
+
+// WithQueueOptions declares the queue with q instead of the queue the
+// SimpleQueueType passed to Subscribe stands for. Undecodable messages go
+// where q dead-letters to. A q that dead-letters nowhere takes its exchange
+// from WithDeadLetterExchange if that is given, and otherwise undecodable
+// messages are dropped like anything else it rejects; q naming a different
+// target than WithDeadLetterExchange is an error. q is validated before the
+// broker is asked for anything.
+func WithQueueOptions(q QueueOptions) SubscribeOption {
+	return func(o *subscribeOptions) {
+		// A copy, since newSubscribeOptions fills in its dead letter
+		// exchange and the option may be reused
+		qc := q
+		o.queue = &qc
+	}
+}
+
+// queueOptions is how the subscription's queue is declared, validated.
+func (o subscribeOptions) queueOptions(simpleQueueType SimpleQueueType) (QueueOptions, error) {
+	q := simpleQueueType.QueueOptions()
+	q.DeadLetterExchange = o.deadLetterExchange
+	if o.queue != nil {
+		q = *o.queue
+	}
+	if o.maxPriority > 0 {
+		q.MaxPriority = o.maxPriority
+	}
+
+	err := q.Validate()
+	if q.DeadLetterExchange != o.deadLetterExchange {
+		err = errors.Join(err, fmt.Errorf("queue options dead-letter to %q, but the dead letter exchange is %s", q.DeadLetterExchange, o.deadLetterExchange))
+	}
+	return q, err
+}
+
+// WithCodecs replaces DefaultCodecs as the set of content types a typed
+// subscription understands.
+func WithCodecs(codecs *CodecRegistry) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.codecs = codecs
+	}
+}
+
+// WithFallbackCodec decodes messages that arrive without a Content-Type.
+func WithFallbackCodec(codec Codec) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.fallbackCodec = codec
+	}
+}
+
+// Subscribe decodes each message with the codec registered for its
+// Content-Type, so publishers can switch encodings without breaking
+// subscribers that are already running.
+func Subscribe[T any](
+	ctx context.Context,
+	sub Subscriber,
 	exchange,
 	queueName,
 	key string,
 	simpleQueueType SimpleQueueType,
 	handler func(T) AckType,
-) error {
-	return subscribe[T](
-		conn,
-		exchange,
-		queueName,
-		key,
-		simpleQueueType,
-		handler,
-		func(data []byte) (T, error) {
-			buf := bytes.NewBuffer(data)
-			decoder := gob.NewDecoder(buf)
-			var content T
-			err := decoder.Decode(&content)
-			return content, err
-		},
-	)
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return SubscribeWithMetadata(ctx, sub, exchange, queueName, key, simpleQueueType, func(val T, _ Metadata) AckType {
+		return handler(val)
+	}, opts...)
 }
 
-func SubscribeJSON[T any](
-	conn *amqp.Connection,
+// SubscribeWithMetadata is Subscribe for handlers that also want to know
+// about the message itself, such as its ID or who published it.
+func SubscribeWithMetadata[T any](
+	ctx context.Context,
+	sub Subscriber,
 	exchange,
 	queueName,
 	key string,
 	simpleQueueType SimpleQueueType,
-	handler func(T) AckType,
-) error {
-	return subscribe[T](
-		conn,
+	handler func(T, Metadata) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	o := newSubscribeOptions(opts)
+	decoder := func(d Delivery) (T, error) {
+		return decode[T](o.codecs, o.fallbackCodec, d)
+	}
+
+	if o.valueKey != nil {
+		valueKey, ok := o.valueKey.(func(T) string)
+		if !ok {
+			return nil, fmt.Errorf("ordering key %T doesn't take the subscribed message type", o.valueKey)
+		}
+		opts = append(opts, OrderBy(func(d Delivery) string {
+			content, err := decoder(d)
+			if err != nil {
+				// Let the handler deal with it
+				return ""
+			}
+			return valueKey(content)
+		}))
+	}
+
+	// Both brokers publish too, which is how undecodable messages get
+	// republished with their failure headers.
+	pub, _ := sub.(Publisher)
+
+	return sub.Subscribe(
+		ctx,
 		exchange,
 		queueName,
 		key,
 		simpleQueueType,
-		handler,
-		func(data []byte) (T, error) {
-			var content T
-			err := json.Unmarshal(data, &content)
-			return content, err
+		func(d Delivery) (ackType AckType) {
+			traceParent, _ := d.Headers[tracing.TraceParentHeader].(string)
+			// A missing or broken traceparent starts a new trace
+			parent, _ := tracing.ParseTraceParent(traceParent)
+			// The handler gets to finish its message during shutdown, so it
+			// shouldn't be handed a context that is already cancelled
+			ctx, span := tracing.Start(context.WithoutCancel(ctx), parent, queueName+" process")
+			defer span.End()
+			span.SetAttribute("messaging.source", queueName)
+			span.SetAttribute("messaging.routing_key", d.RoutingKey)
+			span.SetAttribute("messaging.message_id", d.MessageID)
+			defer func() {
+				span.SetAttribute("messaging.ack", ackType.label())
+			}()
+
+			content, err := decoder(d)
+			if err != nil {
+				logger().Warn("couldn't decode message", append(d.logAttrs(),
+					"content_type", d.ContentType,
+					"err", err,
+				)...)
+				span.RecordError(err)
+				return o.decodeFailure.handle(pub, o.deadLetterExchange, queueName, d, err)
+			}
+			meta := newMetadata(d)
+			meta.ctx = ctx
+			return handler(content, meta)
 		},
+		opts...,
 	)
 }
 
-func subscribe[T any](
-	conn *amqp.Connection,
+func SubscribeGob[T any](
+	sub Subscriber,
 	exchange,
 	queueName,
 	key string,
 	simpleQueueType SimpleQueueType,
 	handler func(T) AckType,
-	unmarshaller func([]byte) (T, error),
+	opts ...SubscribeOption,
 ) error {
-	ch, queue, err := DeclareAndBind(conn, exchange, queueName, key, simpleQueueType)
-	if err != nil {
-		return fmt.Errorf("couldn't declare and bind queue: %w", err)
-	}
-
-	// Prefetch configuration
-	if err := ch.Qos(10, 0, false); err != nil {
-		return fmt.Errorf("couldn't set channel prefetch count: %w", err)
-	}
-	deliveryChan, err := ch.Consume(
-		queue.Name, // queue
-		"",         // consumer
-		false,      // auto-ack
-		false,      // exclusive
-		false,      // no-Local
-		false,      // no-Wait
-		nil,        //args
-	)
-	if err != nil {
-		return fmt.Errorf("couldn't start consuming: %w", err)
-	}
-
-	go func() {
-		for msg := range deliveryChan {
-			content, err := unmarshaller(msg.Body)
-			if err != nil {
-				fmt.Printf("Couldn't unmarshal message: %v", err)
-				continue
-			}
-
-			ackType := handler(content)
-			switch ackType {
-			case Ack:
-				if err := msg.Ack(false); err != nil {
-					fmt.Printf("Couldn't acknowledge message: %v\n", err)
-				}
-			case NackRequeue:
-				if err := msg.Nack(false, true); err != nil {
-					fmt.Printf("Couldn't nack message: %v\n", err)
-				}
-			case NackDiscard:
-				if err := msg.Nack(false, false); err != nil {
-					fmt.Printf("Couldn't discard message: %v\n", err)
-				}
-			}
-		}
-	}()
-
-	return nil
+	_, err := SubscribeGobWithContext(context.Background(), sub, exchange, queueName, key, simpleQueueType, handler, opts...)
+	return err
 }
 
-func DeclareAndBind(
-	conn *amqp.Connection,
+// SubscribeGobWithContext is Subscribe, treating messages without a
+// Content-Type as gob.
+func SubscribeGobWithContext[T any](
+	ctx context.Context,
+	sub Subscriber,
 	exchange,
 	queueName,
 	key string,
 	simpleQueueType SimpleQueueType,
-) (*amqp.Channel, amqp.Queue, error) {
-	ch, err := conn.Channel()
-	if err != nil {
-		return nil, amqp.Queue{}, fmt.Errorf("couldn't create channel: %w", err)
-	}
-
-	queue, err := ch.QueueDeclare(
-		queueName,                             // name
-		simpleQueueType == SimpleQueueDurable, // durable
-		simpleQueueType != SimpleQueueDurable, // delete when unused
-		simpleQueueType != SimpleQueueDurable, // exclusive
-		false,                                 // no-wait
-		amqp.Table{
-			// This optional argument set the DLX for this queue
-			"x-dead-letter-exchange": routing.ExchangePerilDeadLetter,
-		}, // arguments
-	)
-	if err != nil {
-		return nil, amqp.Queue{}, fmt.Errorf("couldn't declare queue: %w", err)
-	}
+	handler func(T) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return Subscribe(ctx, sub, exchange, queueName, key, simpleQueueType, handler, append(opts, WithFallbackCodec(Gob))...)
+}
 
-	err = ch.QueueBind(
-		queue.Name, // queue name
-		key,        // routing key
-		exchange,   // exchange
-		false,      // no-wait
-		nil,        // args
-	)
-	if err != nil {
-		return nil, amqp.Queue{}, fmt.Errorf("couldn't bind queue: %w", err)
-	}
+func SubscribeJSON[T any](
+	sub Subscriber,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	handler func(T) AckType,
+	opts ...SubscribeOption,
+) error {
+	_, err := SubscribeJSONWithContext(context.Background(), sub, exchange, queueName, key, simpleQueueType, handler, opts...)
+	return err
+}
 
-	return ch, queue, nil
+// SubscribeJSONWithContext is Subscribe, treating messages without a
+// Content-Type as JSON.
+func SubscribeJSONWithContext[T any](
+	ctx context.Context,
+	sub Subscriber,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	handler func(T) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return Subscribe(ctx, sub, exchange, queueName, key, simpleQueueType, handler, append(opts, WithFallbackCodec(JSON))...)
 }
@@ -0,0 +1,108 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// subscribeUndecodable subscribes a typed handler to queue with opts and
+// publishes a body it can't decode.
+func subscribeUndecodable(t *testing.T, b *MemoryBroker, queue string, opts ...SubscribeOption) error {
+	t.Helper()
+	_, err := SubscribeJSONWithContext(context.Background(), b, routing.ExchangePerilDirect, queue, queue, SimpleQueueDurable,
+		func(routing.PlayingState) AckType { return Ack },
+		opts...,
+	)
+	if err != nil {
+		return err
+	}
+	msg := Message{ContentType: "application/json", Body: []byte("not json")}
+	if err := b.Publish(context.Background(), routing.ExchangePerilDirect, queue, msg); err != nil {
+		t.Fatal(err)
+	}
+	return nil
+}
+
+func bindDeadLetterQueue(t *testing.T, b *MemoryBroker, queue, exchange string) {
+	t.Helper()
+	if err := b.DeclareQueue(queue, SimpleQueueDurable, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.BindQueue(queue, "", exchange); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueOptionsTakeDeadLetterExchange(t *testing.T) {
+	b := newTestBroker(t)
+	if err := b.DeclareExchange("custom_dlx", ExchangeKindFanout); err != nil {
+		t.Fatal(err)
+	}
+	bindDeadLetterQueue(t, b, "custom_dlq", "custom_dlx")
+
+	err := subscribeUndecodable(t, b, "options", WithQueueOptions(QueueOptions{Durable: true}), WithDeadLetterExchange("custom_dlx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	declared := b.queues["options"].args["x-dead-letter-exchange"]
+	b.mu.Unlock()
+	if declared != "custom_dlx" {
+		t.Fatalf("queue declared with dead letter exchange %v, want custom_dlx", declared)
+	}
+	waitForQueue(t, b, "custom_dlq", 1)
+}
+
+func TestQueueOptionsWithoutDeadLetterExchange(t *testing.T) {
+	b := newTestBroker(t)
+	bindDeadLetterQueue(t, b, routing.DeadLetterQueue, routing.ExchangePerilDeadLetter)
+
+	if err := subscribeUndecodable(t, b, "options", WithQueueOptions(QueueOptions{Durable: true})); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	waitForQueue(t, b, routing.DeadLetterQueue, 0)
+	waitForQueue(t, b, "options", 0)
+}
+
+func TestQueueOptionsDeadLetterConflict(t *testing.T) {
+	b := newTestBroker(t)
+	err := subscribeUndecodable(t, b, "options",
+		WithQueueOptions(QueueOptions{Durable: true, DeadLetterExchange: routing.ExchangePerilDeadLetter}),
+		WithDeadLetterExchange("custom_dlx"),
+	)
+	if err == nil {
+		t.Fatal("subscribed with two different dead letter exchanges")
+	}
+}
+
+func TestQueueOptionsReused(t *testing.T) {
+	b := newTestBroker(t)
+	for _, exchange := range []string{"dlx_a", "dlx_b"} {
+		if err := b.DeclareExchange(exchange, ExchangeKindFanout); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shared := WithQueueOptions(QueueOptions{Durable: true})
+	if err := subscribeUndecodable(t, b, "first", shared, WithDeadLetterExchange("dlx_a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := subscribeUndecodable(t, b, "second", shared, WithDeadLetterExchange("dlx_b")); err != nil {
+		t.Fatalf("couldn't reuse queue options with another dead letter exchange: %v", err)
+	}
+	if err := subscribeUndecodable(t, b, "third", shared); err != nil {
+		t.Fatal(err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for queue, want := range map[string]any{"first": "dlx_a", "second": "dlx_b", "third": nil} {
+		if got := b.queues[queue].args["x-dead-letter-exchange"]; got != want {
+			t.Errorf("%s declared with dead letter exchange %v, want %v", queue, got, want)
+		}
+	}
+}
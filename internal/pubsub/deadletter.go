@@ -0,0 +1,126 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// HeaderReplays counts how often a dead-lettered message has been replayed,
+// so the replay isn't taken for a duplicate of the message that died.
+const HeaderReplays = "x-replays"
+
+// Inspector reads the messages waiting in a queue without subscribing to
+// it, for looking through a dead letter queue.
+type Inspector interface {
+	// Inspect fetches up to max messages from the head of queue, or all of
+	// them if max isn't positive, and calls fn with each in order. Messages
+	// fn returns true for are removed from the queue; the rest are put back
+	// where they were.
+	Inspect(queue string, max int, fn func(i int, d Delivery) bool) error
+	// Purge removes every message waiting in queue and returns how many
+	// there were.
+	Purge(queue string) (int, error)
+}
+
+// Death is one entry of the x-death header the broker adds each time it
+// dead-letters a message.
+type Death struct {
+	Queue       string
+	Reason      string
+	Exchange    string
+	RoutingKeys []string
+	Count       int
+	Time        time.Time
+}
+
+// Deaths reads the x-death header, most recent death first.
+func Deaths(headers map[string]any) []Death {
+	entries, _ := headers["x-death"].([]any)
+	deaths := make([]Death, 0, len(entries))
+	for _, entry := range entries {
+		var table map[string]any
+		switch t := entry.(type) {
+		case amqp.Table:
+			table = t
+		case map[string]any:
+			table = t
+		default:
+			continue
+		}
+		death := Death{Count: intValue(table["count"])}
+		death.Queue, _ = table["queue"].(string)
+		death.Reason, _ = table["reason"].(string)
+		death.Exchange, _ = table["exchange"].(string)
+		death.Time, _ = table["time"].(time.Time)
+		keys, _ := table["routing-keys"].([]any)
+		for _, key := range keys {
+			if s, ok := key.(string); ok {
+				death.RoutingKeys = append(death.RoutingKeys, s)
+			}
+		}
+		deaths = append(deaths, death)
+	}
+	return deaths
+}
+
+// DeadLetterOrigin returns the exchange and routing key a dead-lettered
+// message was first published with. Retries and the decode failure policy
+// record these in headers before the message leaves for another queue, so
+// those come first; otherwise they are read from the oldest x-death entry,
+// since later deaths only show how it came back from a retry queue.
+func DeadLetterOrigin(d Delivery) (exchange, key string, ok bool) {
+	if exchange, ok := d.Headers[HeaderOriginalExchange].(string); ok {
+		key, _ := d.Headers[HeaderOriginalRoutingKey].(string)
+		return exchange, key, true
+	}
+	deaths := Deaths(d.Headers)
+	for i := len(deaths) - 1; i >= 0; i-- {
+		if len(deaths[i].RoutingKeys) > 0 {
+			return deaths[i].Exchange, deaths[i].RoutingKeys[0], true
+		}
+	}
+	return "", "", false
+}
+
+// Replay publishes a dead-lettered message back to where it came from,
+// without the headers that recorded its death, so it gets a fresh set of
+// retries.
+func Replay(ctx context.Context, pub Publisher, d Delivery) error {
+	exchange, key, ok := DeadLetterOrigin(d)
+	if !ok {
+		return fmt.Errorf("message %s has no record of where it came from", d.MessageID)
+	}
+
+	msg := copyMessage(d.Message)
+	if msg.Headers == nil {
+		msg.Headers = map[string]any{}
+	}
+	for _, header := range []string{
+		"x-death",
+		"x-first-death-exchange",
+		"x-first-death-queue",
+		"x-first-death-reason",
+		"x-last-death-exchange",
+		"x-last-death-queue",
+		"x-last-death-reason",
+		headerDeliveryCount,
+		HeaderDecodeError,
+		HeaderDecodeAttempts,
+		HeaderOriginalContentType,
+		HeaderOriginalExchange,
+		HeaderOriginalRoutingKey,
+		HeaderOriginalQueue,
+	} {
+		delete(msg.Headers, header)
+	}
+	msg.Headers[HeaderReplays] = int64(intValue(d.Headers[HeaderReplays]) + 1)
+	msg.Mandatory = true
+
+	if err := pub.Publish(ctx, exchange, key, msg); err != nil {
+		return fmt.Errorf("couldn't replay message to %s with key %s: %w", exchange, key, err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package pubsub
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterOriginAfterRetry(t *testing.T) {
+	broker := NewMemoryBroker()
+	broker.SetMetrics(nil)
+	defer broker.Close()
+	for name, kind := range map[string]ExchangeKind{"moves": ExchangeKindTopic, "dlx": ExchangeKindFanout} {
+		if err := broker.DeclareExchange(name, kind); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := broker.DeclareQueue("dlq", SimpleQueueDurable, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.BindQueue("dlq", "", "dlx"); err != nil {
+		t.Fatal(err)
+	}
+
+	var handled atomic.Int32
+	_, err := broker.Subscribe(context.Background(), "moves", "moves_queue", "army_moves.*", SimpleQueueDurable,
+		func(d Delivery) AckType {
+			if handled.Add(1) == 1 {
+				return RetryAfter(time.Millisecond)
+			}
+			return NackDiscard
+		},
+		WithDeadLetterExchange("dlx"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Publish(context.Background(), "moves", "army_moves.washington", Message{Body: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var dead []Delivery
+	for deadline := time.Now().Add(time.Second); len(dead) == 0 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		err := broker.Inspect("dlq", 0, func(i int, d Delivery) bool {
+			dead = append(dead, d)
+			return false
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(dead) != 1 {
+		t.Fatalf("dead letter queue holds %d messages, want 1", len(dead))
+	}
+	if n := handled.Load(); n != 2 {
+		t.Fatalf("message was handled %d times, want 2", n)
+	}
+
+	exchange, key, ok := DeadLetterOrigin(dead[0])
+	if !ok || exchange != "moves" || key != "army_moves.washington" {
+		t.Fatalf("DeadLetterOrigin() = %q, %q, %v, want moves, army_moves.washington, true", exchange, key, ok)
+	}
+}
+
+func TestDeadLetterOriginFromOldestDeath(t *testing.T) {
+	d := Delivery{}
+	d.Headers = map[string]any{
+		"x-death": []any{
+			map[string]any{"queue": "moves_queue", "reason": "rejected", "exchange": "", "routing-keys": []any{"moves_queue"}, "count": int64(1)},
+			map[string]any{"queue": "moves_queue.retry.1000ms", "reason": "expired", "exchange": "", "routing-keys": []any{"moves_queue.retry.1000ms"}, "count": int64(1)},
+			map[string]any{"queue": "moves_queue", "reason": "rejected", "exchange": "moves", "routing-keys": []any{"army_moves.washington"}, "count": int64(1)},
+		},
+	}
+	exchange, key, ok := DeadLetterOrigin(d)
+	if !ok || exchange != "moves" || key != "army_moves.washington" {
+		t.Fatalf("DeadLetterOrigin() = %q, %q, %v, want moves, army_moves.washington, true", exchange, key, ok)
+	}
+
+	if _, _, ok := DeadLetterOrigin(Delivery{}); ok {
+		t.Fatal("DeadLetterOrigin() found an origin for a message that never died")
+	}
+}
@@ -0,0 +1,254 @@
+package pubsub
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// dedupRetryDelay is how long a message waits when the store can't be
+// reached, rather than running its handler without the guarantee.
+const dedupRetryDelay = time.Second
+
+// DedupStore remembers which messages have already been handled.
+type DedupStore interface {
+	// Claim records key and reports whether it was new. Only the caller
+	// that gets true may run the handler.
+	Claim(key string) (bool, error)
+	// Forget releases a claim whose handler asked for the message again.
+	Forget(key string) error
+}
+
+// WithDedup adds Dedup to the end of the middleware chain.
+func WithDedup(store DedupStore, key func(Delivery) string) SubscribeOption {
+	return WithMiddleware(Dedup(store, key))
+}
+
+func messageIDKey(d Delivery) string {
+	if d.MessageID == "" {
+		return ""
+	}
+	key := d.MessageID
+	if attempts, ok := d.Headers[HeaderDecodeAttempts]; ok {
+		// Each requeue after a decode failure is a fresh copy
+		key = fmt.Sprintf("%s/%d", key, intValue(attempts))
+	}
+	if replays, ok := d.Headers[HeaderReplays]; ok {
+		// and so is each replay from the dead letter queue
+		key = fmt.Sprintf("%s/replay-%d", key, intValue(replays))
+	}
+	return key
+}
+
+// Dedup runs the handler at most once per message. Keys come from key, or
+// the message ID when key is nil; messages without one aren't deduplicated.
+// A message is only remembered once it has been acknowledged or discarded,
+// so requeues and retries still reach the handler. Keys are scoped to the
+// queue because a message routed to several queues should be handled once
+// by each.
+func Dedup(store DedupStore, key func(Delivery) string) Middleware {
+	if key == nil {
+		key = messageIDKey
+	}
+	return func(next func(Delivery) AckType) func(Delivery) AckType {
+		return func(d Delivery) AckType {
+			k := key(d)
+			if k == "" {
+				return next(d)
+			}
+			return dedup(store, d.Queue+"/"+k, next, d)
+		}
+	}
+}
+
+func dedup(store DedupStore, key string, handler func(Delivery) AckType, d Delivery) AckType {
+	claimed, err := store.Claim(key)
+	if err != nil {
+		logger().Error("couldn't check message for duplicates", append(d.logAttrs(), "err", err)...)
+		return RetryAfter(dedupRetryDelay)
+	}
+	if !claimed {
+		return Ack
+	}
+
+	ackType := handler(d)
+	if ackType == Ack || ackType == NackDiscard {
+		return ackType
+	}
+	if err := store.Forget(key); err != nil {
+		logger().Error("couldn't release duplicate check", append(d.logAttrs(), "err", err)...)
+	}
+	return ackType
+}
+
+// MemoryDedupStore keeps up to capacity keys for ttl each, dropping the
+// least recently seen first. Zero for either means no limit.
+type MemoryDedupStore struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+func NewMemoryDedupStore(capacity int, ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+func (s *MemoryDedupStore) Claim(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if el, ok := s.entries[key]; ok {
+		entry := el.Value.(*dedupEntry)
+		if s.ttl <= 0 || now.Sub(entry.seen) < s.ttl {
+			s.order.MoveToFront(el)
+			return false, nil
+		}
+		s.remove(el)
+	}
+
+	s.entries[key] = s.order.PushFront(&dedupEntry{key: key, seen: now})
+	for s.capacity > 0 && s.order.Len() > s.capacity {
+		s.remove(s.order.Back())
+	}
+	return true, nil
+}
+
+func (s *MemoryDedupStore) Forget(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[key]; ok {
+		s.remove(el)
+	}
+	return nil
+}
+
+func (s *MemoryDedupStore) remove(el *list.Element) {
+	s.order.Remove(el)
+	delete(s.entries, el.Value.(*dedupEntry).key)
+}
+
+// FileDedupStore keeps claims for ttl in an append-only file so they
+// survive restarts. Expired claims are dropped as new ones come in, and the
+// file is compacted each time it is opened and whenever it has grown well
+// past the claims still live.
+type FileDedupStore struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	log *appendLog
+	// order holds the claims oldest at the back, so expired ones are found
+	// there
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type dedupRecord struct {
+	Key    string    `json:"key"`
+	Seen   time.Time `json:"seen"`
+	Forget bool      `json:"forget,omitempty"`
+}
+
+func OpenFileDedupStore(path string, ttl time.Duration) (*FileDedupStore, error) {
+	s := &FileDedupStore{ttl: ttl, order: list.New(), entries: map[string]*list.Element{}}
+	err := readAppendLog(path, "dedup store", func(record dedupRecord) {
+		if el, ok := s.entries[record.Key]; ok {
+			s.remove(el)
+		}
+		if record.Forget {
+			return
+		}
+		s.entries[record.Key] = s.order.PushFront(&dedupEntry{key: record.Key, seen: record.Seen})
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.evict(time.Now())
+
+	// Rewrite only what's still live, then append to that
+	if s.log, err = createAppendLog(path, "dedup store", s.records()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileDedupStore) expired(seen, now time.Time) bool {
+	return s.ttl > 0 && now.Sub(seen) >= s.ttl
+}
+
+// evict drops the claims that have expired by now.
+func (s *FileDedupStore) evict(now time.Time) {
+	for el := s.order.Back(); el != nil && s.expired(el.Value.(*dedupEntry).seen, now); el = s.order.Back() {
+		s.remove(el)
+	}
+}
+
+func (s *FileDedupStore) Claim(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.evict(now)
+	if _, ok := s.entries[key]; ok {
+		return false, nil
+	}
+	el := s.order.PushFront(&dedupEntry{key: key, seen: now})
+	s.entries[key] = el
+	var err error
+	if s.log.needsRewrite(s.order.Len()) {
+		err = s.log.rewrite(s.records())
+	} else {
+		err = s.log.append(dedupRecord{Key: key, Seen: now}, false)
+	}
+	if err != nil {
+		s.remove(el)
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *FileDedupStore) Forget(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	s.remove(el)
+	return s.log.append(dedupRecord{Key: key, Seen: time.Now(), Forget: true}, false)
+}
+
+func (s *FileDedupStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.close()
+}
+
+// records are what the store's file needs to hold: a record for each live
+// claim, oldest first.
+func (s *FileDedupStore) records() []any {
+	records := make([]any, 0, s.order.Len())
+	for el := s.order.Back(); el != nil; el = el.Prev() {
+		entry := el.Value.(*dedupEntry)
+		records = append(records, dedupRecord{Key: entry.key, Seen: entry.seen})
+	}
+	return records
+}
+
+func (s *FileDedupStore) remove(el *list.Element) {
+	s.order.Remove(el)
+	delete(s.entries, el.Value.(*dedupEntry).key)
+}
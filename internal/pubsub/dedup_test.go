@@ -0,0 +1,68 @@
+package pubsub
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileDedupStoreEvictsExpiredClaims(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	s, err := OpenFileDedupStore(path, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 3*appendLogSlack; i++ {
+		if _, err := s.Claim(NewMessageID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	if claimed, err := s.Claim("last"); err != nil || !claimed {
+		t.Fatalf("Claim(last) = %v, %v, want true, nil", claimed, err)
+	}
+	if len(s.entries) != 1 || s.order.Len() != 1 {
+		t.Fatalf("store holds %d claims, want 1", len(s.entries))
+	}
+	if claimed, _ := s.Claim("last"); claimed {
+		t.Fatal("Claim(last) claimed a live key twice")
+	}
+	if s.log.lines > 2+appendLogSlack {
+		t.Fatalf("log holds %d lines after eviction, want it compacted", s.log.lines)
+	}
+}
+
+func TestFileDedupStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	s, err := OpenFileDedupStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := s.Claim(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Forget("b"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = OpenFileDedupStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for key, want := range map[string]bool{"a": false, "b": true, "c": false} {
+		if claimed, err := s.Claim(key); err != nil || claimed != want {
+			t.Errorf("Claim(%s) = %v, %v, want %v, nil", key, claimed, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); err == nil {
+		t.Error("compaction left its temporary file behind")
+	}
+}
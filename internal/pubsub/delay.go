@@ -0,0 +1,79 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DelayPublisher is what PublishAfter needs from a broker: somewhere to park
+// the message until it is due.
+type DelayPublisher interface {
+	Publisher
+	DeclareQueue(name string, simpleQueueType SimpleQueueType, args map[string]any) error
+}
+
+func delayQueueName(exchange, key string, delay time.Duration) string {
+	return fmt.Sprintf("%s.%s.delay.%dms", exchange, key, delay.Milliseconds())
+}
+
+// roundDelay rounds delays of a second or more up to whole seconds, so
+// that delays computed from a time, which differ by a few milliseconds each
+// time, share a delay queue.
+func roundDelay(delay time.Duration) time.Duration {
+	if delay < time.Second {
+		return delay.Truncate(time.Millisecond)
+	}
+	if rounded := delay.Truncate(time.Second); rounded != delay {
+		return rounded + time.Second
+	}
+	return delay
+}
+
+// PublishAfter publishes val the way Publish does, but it only reaches
+// exchange once delay has passed. Until then it waits in a delay queue
+// named after the exchange, key and delay, e.g.
+// "peril_direct.pause.delay.30000ms", whose message TTL is the delay. When
+// it expires the broker dead-letters it to exchange with key, so no plugin
+// is needed. A delayed message can't be mandatory: it is routed to the
+// delay queue whether or not anyone is listening for it.
+//
+// Delays under a second are counted in whole milliseconds, anything
+// shorter being published straight away, and longer ones are rounded up to
+// whole seconds. Each distinct delay to an exchange and key declares its
+// own durable queue, which the broker only deletes once it has gone unused
+// for twice the delay plus a minute. Delays longer than MaxDelay fail with
+// ErrDelayTooLong.
+func PublishAfter[T any](ctx context.Context, pub DelayPublisher, exchange, key string, delay time.Duration, val T, opts ...PublishOption) error {
+	delay = roundDelay(delay)
+	if delay <= 0 {
+		return Publish(ctx, pub, exchange, key, val, opts...)
+	}
+	if delay > MaxDelay {
+		return fmt.Errorf("couldn't delay message by %s: %w", delay, ErrDelayTooLong)
+	}
+
+	msg, err := newMessage(ctx, val, opts)
+	if err != nil {
+		return err
+	}
+	msg.Mandatory = false
+
+	delayQueue := delayQueueName(exchange, key, delay)
+	if err := declareTTLQueue(pub, delayQueue, delay, exchange, key); err != nil {
+		return fmt.Errorf("couldn't declare delay queue: %w", err)
+	}
+
+	ctx, span := startPublishSpan(ctx, exchange+" schedule", exchange, key, &msg)
+	defer span.End()
+	span.SetAttribute("messaging.delay_ms", delay.Milliseconds())
+	err = pub.Publish(ctx, "", delayQueue, msg)
+	span.RecordError(err)
+	return err
+}
+
+// PublishAt is PublishAfter with the delay counted until at. Times in the
+// past publish straight away.
+func PublishAt[T any](ctx context.Context, pub DelayPublisher, exchange, key string, at time.Time, val T, opts ...PublishOption) error {
+	return PublishAfter(ctx, pub, exchange, key, time.Until(at), val, opts...)
+}
@@ -0,0 +1,97 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestPublishAfter(t *testing.T) {
+	b := newTestBroker(t)
+	received := make(chan time.Time, 1)
+	_, err := SubscribeJSONWithContext(context.Background(), b, routing.ExchangePerilDirect, "pause.washington", routing.PauseKey, SimpleQueueTransient,
+		func(routing.PlayingState) AckType {
+			received <- time.Now()
+			return Ack
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err = PublishAfter(context.Background(), b, routing.ExchangePerilDirect, routing.PauseKey, 30*time.Millisecond, routing.PlayingState{IsPaused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waited := receive(t, received).Sub(start); waited < 30*time.Millisecond {
+		t.Fatalf("delayed message arrived after %s, want at least 30ms", waited)
+	}
+
+	b.mu.Lock()
+	args := b.queues[delayQueueName(routing.ExchangePerilDirect, routing.PauseKey, 30*time.Millisecond)].args
+	b.mu.Unlock()
+	if args["x-dead-letter-exchange"] != routing.ExchangePerilDirect || args["x-dead-letter-routing-key"] != routing.PauseKey {
+		t.Fatalf("delay queue declared with %v", args)
+	}
+}
+
+func TestRoundDelay(t *testing.T) {
+	tests := map[time.Duration]time.Duration{
+		30 * time.Millisecond:          30 * time.Millisecond,
+		999*time.Millisecond + 999:     999 * time.Millisecond,
+		time.Second:                    time.Second,
+		1500 * time.Millisecond:        2 * time.Second,
+		time.Minute - time.Millisecond: time.Minute,
+		-time.Second:                   -time.Second,
+	}
+	for delay, want := range tests {
+		if got := roundDelay(delay); got != want {
+			t.Errorf("roundDelay(%s) = %s, want %s", delay, got, want)
+		}
+	}
+}
+
+func TestPublishAfterSharesDelayQueues(t *testing.T) {
+	b := newTestBroker(t)
+	for _, delay := range []time.Duration{1200 * time.Millisecond, 1900 * time.Millisecond, 2 * time.Second} {
+		err := PublishAfter(context.Background(), b, routing.ExchangePerilDirect, routing.PauseKey, delay, routing.PlayingState{IsPaused: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForQueue(t, b, delayQueueName(routing.ExchangePerilDirect, routing.PauseKey, 2*time.Second), 3)
+}
+
+func TestPublishAfterTooLong(t *testing.T) {
+	b := newTestBroker(t)
+	err := PublishAfter(context.Background(), b, routing.ExchangePerilDirect, routing.PauseKey, MaxDelay+time.Second, routing.PlayingState{IsPaused: true})
+	if !errors.Is(err, ErrDelayTooLong) {
+		t.Fatalf("err = %v, want ErrDelayTooLong", err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.queues) != 0 {
+		t.Fatalf("declared %d queues for a delay the broker can't hold", len(b.queues))
+	}
+}
+
+func TestPublishAfterLongestDelay(t *testing.T) {
+	b := newTestBroker(t)
+	// MaxDelay isn't a whole number of seconds, so the longest delay that
+	// rounds up to no more than it is a second shorter
+	delay := MaxDelay.Truncate(time.Second)
+	err := PublishAt(context.Background(), b, routing.ExchangePerilDirect, routing.PauseKey, time.Now().Add(delay), routing.PlayingState{IsPaused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	args := b.queues[delayQueueName(routing.ExchangePerilDirect, routing.PauseKey, delay)].args
+	b.mu.Unlock()
+	if expires := intValue(args["x-expires"]); expires > int(MaxDelay.Milliseconds()) {
+		t.Fatalf("delay queue expires after %dms, more than the broker allows", expires)
+	}
+}
@@ -0,0 +1,29 @@
+package pubsub
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+var pkgLogger atomic.Pointer[slog.Logger]
+
+// SetLogger sets where pubsub logs. Until it's called, slog.Default is used.
+func SetLogger(l *slog.Logger) {
+	pkgLogger.Store(l)
+}
+
+func logger() *slog.Logger {
+	if l := pkgLogger.Load(); l != nil {
+		return l
+	}
+	return slog.Default()
+}
+
+// logAttrs are the fields that identify a delivery in log lines.
+func (d Delivery) logAttrs() []any {
+	return []any{
+		slog.String("queue", d.Queue),
+		slog.String("routing_key", d.RoutingKey),
+		slog.String("message_id", d.MessageID),
+	}
+}
@@ -0,0 +1,783 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// maxMemoryPrefetch stands in for an unlimited prefetch count, since each
+// consumer's delivery channel is sized to hold all of its unacked messages.
+const maxMemoryPrefetch = 1024
+
+var errBrokerClosed = errors.New("broker is closed")
+
+// MemoryBroker is an in-process Broker with RabbitMQ-like semantics:
+// direct, topic and fanout exchanges, durable and transient queues,
+// ack/nack/requeue, x-message-ttl, x-max-priority, x-max-length and
+// x-max-length-bytes with every x-overflow policy, x-single-active-consumer,
+// and dead-lettering through x-dead-letter-exchange and
+// x-dead-letter-routing-key. Queue types, lazy mode and x-expires are
+// accepted but make no difference in memory.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	metrics   *Metrics
+	closed    bool
+}
+
+type memExchange struct {
+	kind     ExchangeKind
+	bindings []memBinding
+}
+
+type memBinding struct {
+	queue string
+	key   string
+}
+
+type memQueue struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	args       map[string]any
+	ready      []*memMessage
+	consumers  []*memConsumer
+	next       int
+	seq        uint64
+}
+
+// memMessage remembers its position in the queue so a requeued message
+// goes back where it was, as in RabbitMQ.
+type memMessage struct {
+	Delivery
+	seq uint64
+	// priority is the message's priority capped at the queue's maximum,
+	// always 0 in a queue without one
+	priority  int
+	expiresAt time.Time
+}
+
+type memConsumer struct {
+	queue      *memQueue
+	prefetch   int
+	nextTag    uint64
+	unacked    map[uint64]*memMessage
+	deliveries chan inbound
+	sub        *Subscription
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		exchanges: map[string]*memExchange{},
+		queues:    map[string]*memQueue{},
+		metrics:   DefaultMetrics,
+	}
+}
+
+// SetMetrics replaces DefaultMetrics for everything published and consumed
+// from now on. Nil records nothing.
+func (b *MemoryBroker) SetMetrics(m *Metrics) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.metrics = m
+}
+
+func (b *MemoryBroker) DeclareExchange(name string, kind ExchangeKind) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return errBrokerClosed
+	}
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind {
+			return fmt.Errorf("exchange %s is %s: %w", name, ex.kind, ErrInequivalent)
+		}
+		return nil
+	}
+	b.exchanges[name] = &memExchange{kind: kind}
+	return nil
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return errBrokerClosed
+	}
+	start := time.Now()
+	err := b.route(exchange, key, msg)
+	b.metrics.observePublish(exchange, key, time.Since(start), err)
+	return err
+}
+
+// PublishBatch publishes msgs one after another; there are no confirms to
+// wait for.
+func (b *MemoryBroker) PublishBatch(ctx context.Context, msgs []Envelope) []error {
+	errs := make([]error, len(msgs))
+	for i, m := range msgs {
+		errs[i] = b.Publish(ctx, m.Exchange, m.Key, m.Message)
+	}
+	return errs
+}
+
+func (b *MemoryBroker) Subscribe(
+	ctx context.Context,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	handler func(Delivery) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	o := newSubscribeOptions(opts)
+	queue, err := o.queueOptions(simpleQueueType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for queue %s: %w", queueName, err)
+	}
+	// Prefetch size isn't meaningful in memory and is ignored
+	prefetch := o.prefetchCount
+	if prefetch <= 0 || prefetch > maxMemoryPrefetch {
+		prefetch = maxMemoryPrefetch
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, errBrokerClosed
+	}
+
+	q, err := b.declareQueue(queueName, queue.Durable, queue.AutoDelete, queue.Exclusive, queue.Args())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't declare queue: %w", err)
+	}
+	if exchange != "" {
+		if err := b.bindQueue(q.name, key, exchange); err != nil {
+			return nil, fmt.Errorf("couldn't bind queue: %w", err)
+		}
+	}
+	if q.exclusive && len(q.consumers) > 0 {
+		return nil, fmt.Errorf("couldn't start consuming: queue %s is exclusive", q.name)
+	}
+
+	c := &memConsumer{
+		queue:      q,
+		prefetch:   prefetch,
+		unacked:    map[uint64]*memMessage{},
+		deliveries: make(chan inbound, prefetch),
+	}
+	c.sub = newSubscription(
+		q.name,
+		b,
+		b.metrics,
+		func() error {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.detach(c)
+			return nil
+		},
+		func() error {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.release(c)
+			return nil
+		},
+	)
+	q.consumers = append(q.consumers, c)
+	b.dispatch(q)
+
+	c.sub.start(ctx, c.deliveries, handler, o)
+	return c.sub, nil
+}
+
+func (b *MemoryBroker) DeclareQueue(name string, simpleQueueType SimpleQueueType, args map[string]any) error {
+	return b.DeclareQueueWithOptions(name, simpleQueueType.QueueOptions(), args)
+}
+
+func (b *MemoryBroker) DeclareQueueWithOptions(name string, q QueueOptions, args map[string]any) error {
+	if err := q.Validate(); err != nil {
+		return fmt.Errorf("invalid options for queue %s: %w", name, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return errBrokerClosed
+	}
+	_, err := b.declareQueue(name, q.Durable, q.AutoDelete, q.Exclusive, q.argsWith(args))
+	return err
+}
+
+func (b *MemoryBroker) BindQueue(queueName, key, exchange string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return errBrokerClosed
+	}
+	return b.bindQueue(queueName, key, exchange)
+}
+
+func (b *MemoryBroker) VerifyExchange(name string, kind ExchangeKind) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ex, ok := b.exchanges[name]
+	if !ok {
+		return fmt.Errorf("exchange %s: %w", name, ErrNotFound)
+	}
+	if ex.kind != kind {
+		return fmt.Errorf("exchange %s is %s: %w", name, ex.kind, ErrInequivalent)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) VerifyQueue(name string, simpleQueueType SimpleQueueType, args map[string]any) error {
+	return b.VerifyQueueWithOptions(name, simpleQueueType.QueueOptions(), args)
+}
+
+func (b *MemoryBroker) VerifyQueueWithOptions(name string, o QueueOptions, args map[string]any) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[name]
+	if !ok {
+		return fmt.Errorf("queue %s: %w", name, ErrNotFound)
+	}
+	if q.durable != o.Durable || q.autoDelete != o.AutoDelete || q.exclusive != o.Exclusive || !argsEquivalent(q.args, o.argsWith(args)) {
+		return fmt.Errorf("queue %s: %w", name, ErrInequivalent)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) VerifyBinding(queueName, key, exchange string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("exchange %s: %w", exchange, ErrNotFound)
+	}
+	for _, binding := range ex.bindings {
+		if binding.queue == queueName && binding.key == key {
+			return nil
+		}
+	}
+	return fmt.Errorf("binding of %s to %s with key %s: %w", queueName, exchange, key, ErrNotFound)
+}
+
+// Inspect takes up to max messages off the head of queue while fn looks at
+// them, then puts back the ones fn didn't remove where they were.
+func (b *MemoryBroker) Inspect(queue string, max int, fn func(i int, d Delivery) bool) error {
+	b.mu.Lock()
+	q, ok := b.queues[queue]
+	if !ok {
+		b.mu.Unlock()
+		return fmt.Errorf("queue %s: %w", queue, ErrNotFound)
+	}
+	n := len(q.ready)
+	if max > 0 && max < n {
+		n = max
+	}
+	// Taken off the queue while fn runs, since fn may publish
+	msgs := append([]*memMessage(nil), q.ready[:n]...)
+	q.ready = q.ready[n:]
+	b.mu.Unlock()
+
+	keep := make([]bool, len(msgs))
+	for i, m := range msgs {
+		keep[i] = !fn(i, m.Delivery)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.queues[queue] != q {
+		return nil
+	}
+	for i, m := range msgs {
+		if keep[i] {
+			b.requeue(q, m)
+		}
+	}
+	b.dispatch(q)
+	return nil
+}
+
+// Purge drops every ready message in queue. Messages delivered but not yet
+// acknowledged are left alone, as in RabbitMQ.
+func (b *MemoryBroker) Purge(queue string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return 0, fmt.Errorf("queue %s: %w", queue, ErrNotFound)
+	}
+	n := len(q.ready)
+	q.ready = nil
+	return n, nil
+}
+
+// Close drains every subscription. Unacknowledged messages are requeued.
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	var subs []*Subscription
+	for _, q := range b.queues {
+		for _, c := range q.consumers {
+			subs = append(subs, c.sub)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.Close()
+	}
+	return nil
+}
+
+func (b *MemoryBroker) declareQueue(name string, durable, autoDelete, exclusive bool, args map[string]any) (*memQueue, error) {
+	if q, ok := b.queues[name]; ok {
+		if q.durable != durable || q.autoDelete != autoDelete || q.exclusive != exclusive || !argsEquivalent(q.args, args) {
+			return nil, fmt.Errorf("queue %s: %w", name, ErrInequivalent)
+		}
+		return q, nil
+	}
+
+	q := &memQueue{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       args,
+	}
+	b.queues[name] = q
+	return q, nil
+}
+
+func (b *MemoryBroker) bindQueue(queueName, key, exchange string) error {
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("exchange %s not found", exchange)
+	}
+	if _, ok := b.queues[queueName]; !ok {
+		return fmt.Errorf("queue %s not found", queueName)
+	}
+	for _, binding := range ex.bindings {
+		if binding.queue == queueName && binding.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memBinding{queue: queueName, key: key})
+	return nil
+}
+
+func (b *MemoryBroker) deleteQueue(q *memQueue) {
+	delete(b.queues, q.name)
+	for _, ex := range b.exchanges {
+		bindings := ex.bindings[:0]
+		for _, binding := range ex.bindings {
+			if binding.queue != q.name {
+				bindings = append(bindings, binding)
+			}
+		}
+		ex.bindings = bindings
+	}
+}
+
+// route delivers msg to every queue bound to exchange with a matching key.
+// The empty exchange is the default exchange, which routes by queue name.
+// Unroutable messages are dropped unless msg is mandatory.
+func (b *MemoryBroker) route(exchange, key string, msg Message) error {
+	var queues []*memQueue
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			queues = append(queues, q)
+		}
+	} else {
+		ex, ok := b.exchanges[exchange]
+		if !ok {
+			return fmt.Errorf("exchange %s not found", exchange)
+		}
+		seen := map[string]struct{}{}
+		for _, binding := range ex.bindings {
+			if _, ok := seen[binding.queue]; ok {
+				continue
+			}
+			if !bindingMatches(ex.kind, binding.key, key) {
+				continue
+			}
+			seen[binding.queue] = struct{}{}
+			queues = append(queues, b.queues[binding.queue])
+		}
+	}
+	if len(queues) == 0 && msg.Mandatory {
+		return &UnroutableError{
+			Exchange:   exchange,
+			RoutingKey: key,
+			Reason:     "NO_ROUTE",
+		}
+	}
+
+	rejected := false
+	for _, q := range queues {
+		q.seq++
+		m := &memMessage{
+			Delivery: Delivery{
+				Message:    copyMessage(msg),
+				Queue:      q.name,
+				Exchange:   exchange,
+				RoutingKey: key,
+			},
+			seq:      q.seq,
+			priority: min(int(msg.Priority), intValue(q.args["x-max-priority"])),
+		}
+		if !b.admit(q, m) {
+			rejected = true
+			continue
+		}
+		if ttl := intValue(q.args["x-message-ttl"]); ttl > 0 {
+			m.expiresAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+			b.expireAt(q, m)
+		}
+		q.insert(m)
+		b.dispatch(q)
+	}
+	if rejected {
+		// As RabbitMQ nacks a confirmed publish any queue refused
+		return ErrPublishNacked
+	}
+	return nil
+}
+
+// admit makes room for m within the queue's maximum length, dropping the
+// oldest ready messages or refusing m as its overflow policy says, and
+// reports whether m may join the queue.
+func (b *MemoryBroker) admit(q *memQueue, m *memMessage) bool {
+	maxLength := intValue(q.args["x-max-length"])
+	maxBytes := intValue(q.args["x-max-length-bytes"])
+	if maxLength == 0 && maxBytes == 0 {
+		return true
+	}
+	full := func() bool {
+		if maxLength > 0 && len(q.ready)+1 > maxLength {
+			return true
+		}
+		if maxBytes == 0 {
+			return false
+		}
+		size := len(m.Body)
+		for _, r := range q.ready {
+			size += len(r.Body)
+		}
+		return size > maxBytes
+	}
+
+	overflow, _ := q.args["x-overflow"].(string)
+	switch Overflow(overflow) {
+	case OverflowRejectPublish, OverflowRejectPublishDLX:
+		if !full() {
+			return true
+		}
+		if Overflow(overflow) == OverflowRejectPublishDLX {
+			b.deadLetter(q, &m.Delivery, "maxlen")
+		}
+		return false
+	default:
+		for len(q.ready) > 0 && full() {
+			head := q.ready[0]
+			q.ready = q.ready[1:]
+			b.deadLetter(q, &head.Delivery, "maxlen")
+		}
+		// Only a message too big for the queue on its own is left
+		if full() {
+			b.deadLetter(q, &m.Delivery, "maxlen")
+			return false
+		}
+		return true
+	}
+}
+
+// expireAt dead-letters m if it is still waiting in q when it expires.
+// Messages held by a consumer are checked again if they are requeued.
+func (b *MemoryBroker) expireAt(q *memQueue, m *memMessage) {
+	time.AfterFunc(time.Until(m.expiresAt), func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if b.closed || b.queues[q.name] != q {
+			return
+		}
+		for i, ready := range q.ready {
+			if ready == m {
+				q.ready = append(q.ready[:i], q.ready[i+1:]...)
+				b.deadLetter(q, &m.Delivery, "expired")
+				return
+			}
+		}
+	})
+}
+
+// dispatch hands ready messages to consumers round-robin, never letting a
+// consumer hold more unacknowledged messages than its prefetch count.
+func (b *MemoryBroker) dispatch(q *memQueue) {
+	for len(q.ready) > 0 && len(q.consumers) > 0 {
+		candidates := len(q.consumers)
+		if active, _ := q.args["x-single-active-consumer"].(bool); active {
+			// The longest-standing consumer gets everything until it goes
+			candidates = 1
+			q.next = 0
+		}
+		var c *memConsumer
+		for i := 0; i < candidates; i++ {
+			candidate := q.consumers[(q.next+i)%len(q.consumers)]
+			if len(candidate.unacked) < candidate.prefetch {
+				c = candidate
+				q.next = (q.next + i + 1) % len(q.consumers)
+				break
+			}
+		}
+		if c == nil {
+			return
+		}
+
+		m := q.ready[0]
+		q.ready = q.ready[1:]
+		c.nextTag++
+		tag := c.nextTag
+		c.unacked[tag] = m
+		c.deliveries <- inbound{
+			Delivery: m.Delivery,
+			ack:      func() error { return b.settle(c, tag, Ack) },
+			nack: func(requeue bool) error {
+				if requeue {
+					return b.settle(c, tag, NackRequeue)
+				}
+				return b.settle(c, tag, NackDiscard)
+			},
+		}
+	}
+}
+
+func (b *MemoryBroker) settle(c *memConsumer, tag uint64, ackType AckType) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m, ok := c.unacked[tag]
+	if !ok {
+		return fmt.Errorf("unknown delivery tag %d", tag)
+	}
+	delete(c.unacked, tag)
+
+	q := c.queue
+	switch ackType {
+	case NackRequeue:
+		b.requeue(q, m)
+	case NackDiscard:
+		b.deadLetter(q, &m.Delivery, "rejected")
+	}
+	b.dispatch(q)
+	return nil
+}
+
+// detach stops dispatching to c. Messages it already holds can still be
+// settled until it is released.
+func (b *MemoryBroker) detach(c *memConsumer) {
+	q := c.queue
+	for i, other := range q.consumers {
+		if other == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	q.next = 0
+}
+
+// release requeues whatever c never settled and deletes its queue if that
+// was the last consumer of an auto-delete queue.
+func (b *MemoryBroker) release(c *memConsumer) {
+	q := c.queue
+	for _, m := range c.unacked {
+		b.requeue(q, m)
+	}
+	c.unacked = map[uint64]*memMessage{}
+
+	if q.autoDelete && len(q.consumers) == 0 {
+		b.deleteQueue(q)
+		return
+	}
+	b.dispatch(q)
+}
+
+func (b *MemoryBroker) requeue(q *memQueue, m *memMessage) {
+	if !m.expiresAt.IsZero() && !time.Now().Before(m.expiresAt) {
+		b.deadLetter(q, &m.Delivery, "expired")
+		return
+	}
+
+	m.Redelivered = true
+	// The handler may still hold the old headers
+	m.Message = copyMessage(m.Message)
+	if m.Headers == nil {
+		m.Headers = map[string]any{}
+	}
+	m.Headers[headerDeliveryCount] = int64(intValue(m.Headers[headerDeliveryCount]) + 1)
+	q.insert(m)
+}
+
+// insert puts m among the ready messages, behind those of the same or
+// higher priority that were published before it.
+func (q *memQueue) insert(m *memMessage) {
+	i := sort.Search(len(q.ready), func(i int) bool {
+		r := q.ready[i]
+		return m.priority > r.priority || (m.priority == r.priority && m.seq < r.seq)
+	})
+	q.ready = append(q.ready, nil)
+	copy(q.ready[i+1:], q.ready[i:])
+	q.ready[i] = m
+}
+
+// deadLetter republishes d to the queue's dead letter exchange, if it has
+// one, recording why in the x-death header the same way RabbitMQ does.
+func (b *MemoryBroker) deadLetter(q *memQueue, d *Delivery, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := d.RoutingKey
+	if dlk, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = dlk
+	}
+
+	msg := copyMessage(d.Message)
+	msg.Mandatory = false
+	if msg.Headers == nil {
+		msg.Headers = map[string]any{}
+	}
+	msg.Headers["x-death"] = appendXDeath(msg.Headers["x-death"], q.name, reason, d.Exchange, d.RoutingKey)
+
+	// A missing dead letter exchange silently drops the message, as RabbitMQ does.
+	if dlx != "" {
+		if _, ok := b.exchanges[dlx]; !ok {
+			return
+		}
+	}
+	_ = b.route(dlx, key, msg)
+}
+
+func appendXDeath(existing any, queue, reason, exchange, routingKey string) []any {
+	deaths, _ := existing.([]any)
+	for i, death := range deaths {
+		table, ok := death.(amqp.Table)
+		if !ok || table["queue"] != queue || table["reason"] != reason {
+			continue
+		}
+		count, _ := table["count"].(int64)
+		updated := amqp.Table{}
+		for k, v := range table {
+			updated[k] = v
+		}
+		updated["count"] = count + 1
+		updated["time"] = time.Now()
+		// RabbitMQ keeps the most recent death first.
+		rest := append(append([]any{}, deaths[:i]...), deaths[i+1:]...)
+		return append([]any{updated}, rest...)
+	}
+
+	return append([]any{amqp.Table{
+		"count":        int64(1),
+		"reason":       reason,
+		"queue":        queue,
+		"time":         time.Now(),
+		"exchange":     exchange,
+		"routing-keys": []any{routingKey},
+	}}, deaths...)
+}
+
+// argsEquivalent compares queue arguments the way RabbitMQ does, treating
+// integers of different Go types as equal.
+func argsEquivalent(a, b map[string]any) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, av := range a {
+		bv, ok := b[k]
+		if !ok {
+			return false
+		}
+		if isInt(av) && isInt(bv) {
+			if intValue(av) != intValue(bv) {
+				return false
+			}
+			continue
+		}
+		if fmt.Sprint(av) != fmt.Sprint(bv) {
+			return false
+		}
+	}
+	return true
+}
+
+func copyMessage(msg Message) Message {
+	if msg.Headers != nil {
+		headers := make(map[string]any, len(msg.Headers))
+		for k, v := range msg.Headers {
+			headers[k] = v
+		}
+		msg.Headers = headers
+	}
+	msg.Body = append([]byte(nil), msg.Body...)
+	return msg
+}
+
+func bindingMatches(kind ExchangeKind, pattern, key string) bool {
+	switch kind {
+	case ExchangeKindFanout:
+		return true
+	case ExchangeKindTopic:
+		return topicMatches(strings.Split(pattern, "."), strings.Split(key, "."))
+	default:
+		return pattern == key
+	}
+}
+
+// topicMatches implements AMQP topic matching: "*" matches exactly one
+// word and "#" matches zero or more words.
+func topicMatches(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatches(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && topicMatches(pattern[1:], words[1:])
+	}
+}
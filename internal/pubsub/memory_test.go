@@ -0,0 +1,363 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func newTestBroker(t *testing.T) *MemoryBroker {
+	t.Helper()
+	b := NewMemoryBroker()
+	b.SetMetrics(nil)
+	t.Cleanup(func() { b.Close() })
+	for name, kind := range map[string]ExchangeKind{
+		routing.ExchangePerilDirect:     ExchangeKindDirect,
+		routing.ExchangePerilTopic:      ExchangeKindTopic,
+		routing.ExchangePerilDeadLetter: ExchangeKindFanout,
+	} {
+		if err := b.DeclareExchange(name, kind); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b
+}
+
+// receive waits for the next value from ch.
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a delivery")
+		panic("unreachable")
+	}
+}
+
+// waitForQueue waits until queue holds n ready messages and returns them.
+func waitForQueue(t *testing.T, b *MemoryBroker, queue string, n int) []Delivery {
+	t.Helper()
+	var ds []Delivery
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		ds = nil
+		err := b.Inspect(queue, 0, func(i int, d Delivery) bool {
+			ds = append(ds, d)
+			return false
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ds) == n {
+			return ds
+		}
+	}
+	t.Fatalf("queue %s holds %d messages, want %d", queue, len(ds), n)
+	return nil
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"army_moves.*", "army_moves.washington", true},
+		{"army_moves.*", "army_moves", false},
+		{"army_moves.*", "army_moves.washington.north", false},
+		{"*.washington", "army_moves.washington", true},
+		{"army_moves.#", "army_moves", true},
+		{"army_moves.#", "army_moves.washington.north", true},
+		{"#", "anything.at.all", true},
+		{"#.north", "army_moves.washington.north", true},
+		{"#.north", "army_moves.washington.south", false},
+		{"army_moves.#.north", "army_moves.north", true},
+		{"*.*", "war", false},
+		{"war", "war", true},
+	}
+	for _, tt := range tests {
+		if got := bindingMatches(ExchangeKindTopic, tt.pattern, tt.key); got != tt.want {
+			t.Errorf("bindingMatches(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestTopicRouting(t *testing.T) {
+	b := newTestBroker(t)
+	for queue, key := range map[string]string{"one_word": "army_moves.*", "any_words": "army_moves.#"} {
+		if err := b.DeclareQueue(queue, SimpleQueueDurable, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.BindQueue(queue, key, routing.ExchangePerilTopic); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, key := range []string{"army_moves", "army_moves.washington", "army_moves.washington.north", "war.washington"} {
+		if err := b.Publish(context.Background(), routing.ExchangePerilTopic, key, Message{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := func(ds []Delivery) []string {
+		var keys []string
+		for _, d := range ds {
+			keys = append(keys, d.RoutingKey)
+		}
+		return keys
+	}
+	if got := keys(waitForQueue(t, b, "one_word", 1)); got[0] != "army_moves.washington" {
+		t.Errorf("army_moves.* got %v", got)
+	}
+	if got := keys(waitForQueue(t, b, "any_words", 3)); fmt.Sprint(got) != "[army_moves army_moves.washington army_moves.washington.north]" {
+		t.Errorf("army_moves.# got %v", got)
+	}
+}
+
+func TestAckNackRequeue(t *testing.T) {
+	b := newTestBroker(t)
+	type result struct {
+		body        string
+		redelivered bool
+	}
+	results := make(chan result, 10)
+	_, err := b.Subscribe(context.Background(), routing.ExchangePerilDirect, "acks", "acks", SimpleQueueDurable,
+		func(d Delivery) AckType {
+			results <- result{string(d.Body), d.Redelivered}
+			switch {
+			case string(d.Body) == "requeue" && !d.Redelivered:
+				return NackRequeue
+			case string(d.Body) == "discard":
+				return NackDiscard
+			}
+			return Ack
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"ack", "requeue", "discard"} {
+		if err := b.Publish(context.Background(), routing.ExchangePerilDirect, "acks", Message{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []result
+	for i := 0; i < 4; i++ {
+		got = append(got, receive(t, results))
+	}
+	sort.Slice(got, func(i, j int) bool {
+		return got[i].body < got[j].body || got[i].body == got[j].body && !got[i].redelivered
+	})
+	want := []result{{"ack", false}, {"discard", false}, {"requeue", false}, {"requeue", true}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("deliveries = %v, want %v", got, want)
+	}
+
+	select {
+	case r := <-results:
+		t.Fatalf("unexpected delivery %v", r)
+	case <-time.After(20 * time.Millisecond):
+	}
+	waitForQueue(t, b, "acks", 0)
+}
+
+func TestExclusiveQueue(t *testing.T) {
+	b := newTestBroker(t)
+	handler := func(Delivery) AckType { return Ack }
+	sub, err := b.Subscribe(context.Background(), routing.ExchangePerilDirect, "pause.washington", routing.PauseKey, SimpleQueueTransient, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe(context.Background(), routing.ExchangePerilDirect, "pause.washington", routing.PauseKey, SimpleQueueTransient, handler); err == nil {
+		t.Fatal("a second consumer was allowed on an exclusive queue")
+	}
+
+	// Deleted with its last consumer, so it can be declared afresh
+	sub.Close()
+	sub, err = b.Subscribe(context.Background(), routing.ExchangePerilDirect, "pause.washington", routing.PauseKey, SimpleQueueTransient, handler)
+	if err != nil {
+		t.Fatalf("couldn't subscribe after the last consumer left: %v", err)
+	}
+	sub.Close()
+}
+
+func TestDeadLettering(t *testing.T) {
+	b := newTestBroker(t)
+	if err := b.DeclareQueue(routing.DeadLetterQueue, SimpleQueueDurable, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.BindQueue(routing.DeadLetterQueue, "", routing.ExchangePerilDeadLetter); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := b.Subscribe(context.Background(), routing.ExchangePerilTopic, "rejects", "rejected.*", SimpleQueueDurable,
+		func(Delivery) AckType { return NackDiscard },
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.DeclareQueue("expires", SimpleQueueDurable, map[string]any{
+		"x-message-ttl":          int64(10),
+		"x-dead-letter-exchange": routing.ExchangePerilDeadLetter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.BindQueue("expires", "expired.*", routing.ExchangePerilTopic); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"rejected.washington", "expired.washington"} {
+		if err := b.Publish(context.Background(), routing.ExchangePerilTopic, key, Message{Body: []byte(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reasons := map[string]string{}
+	for _, d := range waitForQueue(t, b, routing.DeadLetterQueue, 2) {
+		deaths := Deaths(d.Headers)
+		if len(deaths) != 1 {
+			t.Fatalf("%s has %d deaths, want 1", d.Body, len(deaths))
+		}
+		reasons[string(d.Body)] = deaths[0].Queue + " " + deaths[0].Reason
+		if exchange, key, _ := DeadLetterOrigin(d); exchange != routing.ExchangePerilTopic || key != string(d.Body) {
+			t.Errorf("%s came from %s with key %s", d.Body, exchange, key)
+		}
+	}
+	want := map[string]string{"rejected.washington": "rejects rejected", "expired.washington": "expires expired"}
+	if fmt.Sprint(reasons) != fmt.Sprint(want) {
+		t.Fatalf("deaths = %v, want %v", reasons, want)
+	}
+}
+
+// TestGameFlow plays a move that starts a war, and checks the war ends up
+// in the game log, the way clients and the server pass them along.
+func TestGameFlow(t *testing.T) {
+	b := newTestBroker(t)
+	ctx := context.Background()
+	washington := gamelogic.NewGameState("washington")
+	lee := gamelogic.NewGameState("lee")
+	for gs, spawn := range map[*gamelogic.GameState][]string{
+		washington: {"spawn", "asia", "artillery"},
+		lee:        {"spawn", "europe", "infantry"},
+	} {
+		if err := gs.CommandSpawn(spawn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gameLogs := make(chan routing.GameLog, 1)
+	_, err := SubscribeGobWithContext(ctx, b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", SimpleQueueDurable,
+		func(gl routing.GameLog) AckType {
+			gameLogs <- gl
+			return Ack
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, gs := range []*gamelogic.GameState{washington, lee} {
+		gs := gs
+		_, err := SubscribeJSONWithContext(ctx, b, routing.ExchangePerilTopic, routing.ArmyMovesPrefix+"."+gs.GetUsername(), routing.ArmyMovesPrefix+".*", SimpleQueueTransient,
+			func(move gamelogic.ArmyMove) AckType {
+				if gs.HandleMove(move) != gamelogic.MoveOutcomeMakeWar {
+					return Ack
+				}
+				war := gamelogic.RecognitionOfWar{Attacker: move.Player, Defender: gs.GetPlayerSnap()}
+				if err := Publish(ctx, b, routing.ExchangePerilTopic, routing.WarRecognitionsPrefix+"."+gs.GetUsername(), war); err != nil {
+					return NackRequeue
+				}
+				return Ack
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Both players share the war queue; whoever isn't in the war puts
+		// it back for the other
+		_, err = SubscribeJSONWithContext(ctx, b, routing.ExchangePerilTopic, routing.WarRecognitionsPrefix, routing.WarRecognitionsPrefix+".*", SimpleQueueDurable,
+			func(rw gamelogic.RecognitionOfWar) AckType {
+				outcome, winner, loser := gs.HandleWar(rw)
+				if outcome == gamelogic.WarOutcomeNotInvolved {
+					return NackRequeue
+				}
+				gl := routing.GameLog{
+					CurrentTime: time.Now(),
+					Message:     fmt.Sprintf("%s won a war against %s", winner, loser),
+					Username:    gs.GetUsername(),
+				}
+				if err := Publish(ctx, b, routing.ExchangePerilTopic, routing.GameLogSlug+"."+gs.GetUsername(), gl, WithCodec(Gob)); err != nil {
+					return NackRequeue
+				}
+				return Ack
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	move, err := washington.PlanMove([]string{"move", "europe", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	washington.ApplyMove(move)
+	if err := Publish(ctx, b, routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".washington", move); err != nil {
+		t.Fatal(err)
+	}
+
+	gl := receive(t, gameLogs)
+	if gl.Username != "washington" || gl.Message != "washington won a war against lee" {
+		t.Fatalf("game log = %+v, want washington's win against lee", gl)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	b := newTestBroker(t)
+	q := QueueOptions{Durable: true, MaxPriority: 10, DeadLetterExchange: routing.ExchangePerilDeadLetter}
+	if err := b.DeclareQueue("priority", SimpleQueueDurable, q.Args()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.BindQueue("priority", "priority", routing.ExchangePerilDirect); err != nil {
+		t.Fatal(err)
+	}
+
+	// Priorities above the queue's maximum count as the maximum, and equal
+	// priorities keep the order they were published in
+	for _, m := range []struct {
+		body     string
+		priority uint8
+	}{{"low 1", 0}, {"capped", 200}, {"low 2", 0}, {"high", 10}, {"middle", 5}} {
+		msg := Message{Body: []byte(m.body), Priority: m.priority}
+		if err := b.Publish(context.Background(), routing.ExchangePerilDirect, "priority", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bodies := make(chan string, 5)
+	_, err := b.Subscribe(context.Background(), routing.ExchangePerilDirect, "priority", "priority", SimpleQueueDurable,
+		func(d Delivery) AckType {
+			bodies <- string(d.Body)
+			return Ack
+		},
+		WithMaxPriority(10),
+		WithPrefetch(1, 0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for i := 0; i < 5; i++ {
+		got = append(got, receive(t, bodies))
+	}
+	if want := "[capped high middle low 1 low 2]"; fmt.Sprint(got) != want {
+		t.Fatalf("delivered %v, want %s", got, want)
+	}
+}
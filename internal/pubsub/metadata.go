@@ -0,0 +1,105 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+)
+
+// HeaderPublisher names the player or service that published a message.
+// AMQP's own user-id property is checked against the connection's login,
+// so it can't carry a username.
+const HeaderPublisher = "x-publisher"
+
+// headerDeliveryCount is set by RabbitMQ quorum queues, and by MemoryBroker,
+// each time a message is requeued.
+const headerDeliveryCount = "x-delivery-count"
+
+// Metadata describes a received message, for handlers that need more than
+// its decoded body.
+type Metadata struct {
+	MessageID     string
+	CorrelationID string
+	// Timestamp is when the message was published, if the publisher said.
+	Timestamp time.Time
+	AppID     string
+	Publisher string
+	// ContentType is the encoding the message arrived in
+	ContentType string
+	ReplyTo     string
+	Queue       string
+	Exchange    string
+	// RoutingKey is the key the message was last published with, which for
+	// retried or requeued messages is the queue name.
+	RoutingKey  string
+	Redelivered bool
+	// DeliveryCount is how many times this message has been handed to a
+	// consumer, counting this one, as far as the broker can tell.
+	DeliveryCount int
+	Headers       map[string]any
+
+	ctx context.Context
+}
+
+// Context carries the span handling the message. Publish with it so that
+// whatever the handler sends joins the same trace.
+func (m Metadata) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+func newMetadata(d Delivery) Metadata {
+	publisher, _ := d.Headers[HeaderPublisher].(string)
+	return Metadata{
+		MessageID:     d.MessageID,
+		CorrelationID: d.CorrelationID,
+		Timestamp:     d.Timestamp,
+		AppID:         d.AppID,
+		Publisher:     publisher,
+		ContentType:   d.ContentType,
+		ReplyTo:       d.ReplyTo,
+		Exchange:      d.Exchange,
+		RoutingKey:    d.RoutingKey,
+		Redelivered:   d.Redelivered,
+		Queue:         d.Queue,
+		DeliveryCount: deliveryCount(d),
+		Headers:       d.Headers,
+	}
+}
+
+func deliveryCount(d Delivery) int {
+	count := 1 + retryAttempts(d.Headers, d.Queue)
+	if n, ok := d.Headers[headerDeliveryCount]; ok {
+		return count + intValue(n)
+	}
+	if d.Redelivered {
+		// Classic queues only say that there was an earlier attempt
+		count++
+	}
+	return count
+}
+
+// readRandom is crypto/rand.Read, replaced in tests.
+var readRandom = rand.Read
+
+// fallbackIDs counts the message IDs made without randomness.
+var fallbackIDs atomic.Uint64
+
+// NewMessageID returns a random ID for a message. Publish uses it for
+// messages that weren't given one. If there is no randomness to be had the
+// ID is made from the time and a counter instead, which is still unique
+// within the process and unlikely to clash across processes.
+func NewMessageID() string {
+	var id [16]byte
+	if _, err := readRandom(id[:]); err != nil {
+		logger().Warn("couldn't make a random message ID, using the time instead", "err", err)
+		binary.BigEndian.PutUint64(id[:8], uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint64(id[8:], fallbackIDs.Add(1))
+	}
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,95 @@
+package pubsub
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestNewMessageID(t *testing.T) {
+	a, b := NewMessageID(), NewMessageID()
+	if len(a) != 32 || a == b {
+		t.Fatalf("IDs %q and %q, want two different 32 digit IDs", a, b)
+	}
+}
+
+func TestNewMessageIDWithoutRandomness(t *testing.T) {
+	readRandom = func([]byte) (int, error) { return 0, errors.New("no entropy") }
+	t.Cleanup(func() { readRandom = rand.Read })
+	SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() { SetLogger(nil) })
+
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		id := NewMessageID()
+		if len(id) != 32 || seen[id] {
+			t.Fatalf("ID %q is malformed or repeated", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestNewMetadata(t *testing.T) {
+	published := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	d := Delivery{
+		Message: Message{
+			ContentType:   "application/json",
+			MessageID:     "message",
+			CorrelationID: "correlation",
+			Timestamp:     published,
+			AppID:         "peril",
+			ReplyTo:       "rpc.reply.1",
+			Headers:       map[string]any{HeaderPublisher: "washington"},
+		},
+		Queue:      "army_moves.lee",
+		Exchange:   "peril_topic",
+		RoutingKey: "army_moves.washington",
+	}
+	want := Metadata{
+		MessageID:     "message",
+		CorrelationID: "correlation",
+		Timestamp:     published,
+		AppID:         "peril",
+		Publisher:     "washington",
+		ContentType:   "application/json",
+		ReplyTo:       "rpc.reply.1",
+		Queue:         "army_moves.lee",
+		Exchange:      "peril_topic",
+		RoutingKey:    "army_moves.washington",
+		DeliveryCount: 1,
+		Headers:       d.Headers,
+	}
+	if got := newMetadata(d); !reflect.DeepEqual(got, want) {
+		t.Fatalf("metadata = %+v, want %+v", got, want)
+	}
+}
+
+func TestDeliveryCount(t *testing.T) {
+	retried := []any{amqp.Table{"queue": "moves.retry.1000ms", "reason": "expired", "count": int64(2)}}
+	tests := []struct {
+		name        string
+		headers     map[string]any
+		redelivered bool
+		want        int
+	}{
+		{"first delivery", nil, false, 1},
+		{"redelivered", nil, true, 2},
+		{"quorum queue", map[string]any{headerDeliveryCount: int64(2)}, true, 3},
+		{"retried", map[string]any{"x-death": retried}, false, 3},
+		{"retried and redelivered", map[string]any{"x-death": retried}, true, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := Delivery{Message: Message{Headers: tt.headers}, Queue: "moves", Redelivered: tt.redelivered}
+			if got := deliveryCount(d); got != tt.want {
+				t.Fatalf("delivery count = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package pubsub
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/metrics"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// Metrics records what the brokers publish and consume. A nil *Metrics
+// records nothing.
+type Metrics struct {
+	published       *metrics.CounterVec
+	publishDuration *metrics.HistogramVec
+	consumed        *metrics.CounterVec
+	handleDuration  *metrics.HistogramVec
+	lag             *metrics.HistogramVec
+	inFlight        *metrics.GaugeVec
+}
+
+// DefaultMetrics records into metrics.DefaultRegistry. Brokers use it unless
+// configured otherwise.
+var DefaultMetrics = NewMetrics(metrics.DefaultRegistry)
+
+func NewMetrics(reg *metrics.Registry) *Metrics {
+	return &Metrics{
+		published: reg.Counter(
+			"peril_pubsub_published_total",
+			"Messages published, by outcome.",
+			"exchange", "routing_key", "result",
+		),
+		publishDuration: reg.Histogram(
+			"peril_pubsub_publish_duration_seconds",
+			"Time taken to publish a message, including waiting for a confirm.",
+			nil,
+			"exchange",
+		),
+		consumed: reg.Counter(
+			"peril_pubsub_consumed_total",
+			"Messages handled, by how they were settled.",
+			"queue", "ack",
+		),
+		handleDuration: reg.Histogram(
+			"peril_pubsub_handler_duration_seconds",
+			"Time taken by subscription handlers.",
+			nil,
+			"queue",
+		),
+		lag: reg.Histogram(
+			"peril_pubsub_lag_seconds",
+			"Time from publishing a message to starting to handle it.",
+			[]float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300},
+			"queue",
+		),
+		inFlight: reg.Gauge(
+			"peril_pubsub_in_flight",
+			"Messages currently being handled.",
+			"queue",
+		),
+	}
+}
+
+func (m *Metrics) observePublish(exchange, key string, took time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	var unroutable *UnroutableError
+	result := "ok"
+	switch {
+	case errors.As(err, &unroutable):
+		result = "unroutable"
+	case err != nil:
+		result = "error"
+	}
+	m.published.With(exchange, metricName(key), result).Inc()
+	m.publishDuration.With(exchange).Observe(took.Seconds())
+}
+
+// instrument is the outermost middleware of every subscription.
+func (m *Metrics) instrument(queueName string) Middleware {
+	return func(next func(Delivery) AckType) func(Delivery) AckType {
+		if m == nil {
+			return next
+		}
+		queueName := metricName(queueName)
+		inFlight := m.inFlight.With(queueName)
+		handleDuration := m.handleDuration.With(queueName)
+		lag := m.lag.With(queueName)
+		return func(d Delivery) AckType {
+			start := time.Now()
+			if !d.Timestamp.IsZero() {
+				lag.Observe(start.Sub(d.Timestamp).Seconds())
+			}
+			inFlight.Add(1)
+			defer inFlight.Add(-1)
+
+			ackType := next(d)
+			handleDuration.Observe(time.Since(start).Seconds())
+			m.consumed.With(queueName, ackType.label()).Inc()
+			return ackType
+		}
+	}
+}
+
+// playerPrefixes start the keys and queues that end in a player's name.
+var playerPrefixes = []string{
+	routing.ArmyMovesPrefix,
+	routing.WarRecognitionsPrefix,
+	routing.PauseKey,
+	routing.GameLogSlug,
+}
+
+// metricName stands in for a queue name or routing key in labels. Names
+// made up on the fly, which would otherwise add a series each, lose the
+// part that varies: reply queues become rpc.reply.*, retry and delay queues
+// <name>.retry.* and <name>.delay.*, per-process queues <name>.server-*,
+// and per-player ones such as army_moves.<username> army_moves.*.
+func metricName(name string) string {
+	if strings.HasPrefix(name, rpcReplyPrefix) {
+		return rpcReplyPrefix + "*"
+	}
+	for _, infix := range []string{".retry.", ".delay."} {
+		i := strings.LastIndex(name, infix)
+		if i >= 0 && strings.HasSuffix(name, "ms") && isDigits(name[i+len(infix):len(name)-2]) {
+			return metricName(name[:i]) + infix + "*"
+		}
+	}
+	if i := strings.LastIndex(name, ".server-"); i >= 0 && isDigits(name[i+len(".server-"):]) {
+		return name[:i] + ".server-*"
+	}
+	for _, prefix := range playerPrefixes {
+		if strings.HasPrefix(name, prefix+".") {
+			return prefix + ".*"
+		}
+	}
+	return name
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package pubsub
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/metrics"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestMetricName(t *testing.T) {
+	tests := map[string]string{
+		"rpc.reply.6f1c2a9e":               "rpc.reply.*",
+		"game_logs.retry.1000ms":           "game_logs.retry.*",
+		"peril_direct.pause.delay.30000ms": "peril_direct.pause.delay.*",
+		"pause.server-4242":                "pause.server-*",
+		"game_logs":                        "game_logs",
+		"army_moves.washington":            "army_moves.*",
+		"pause.washington":                 "pause.*",
+		"game_logs.washington":             "game_logs.*",
+		"war.washington":                   "war.*",
+		"army_moves.lee.retry.1000ms":      "army_moves.*.retry.*",
+		"peril_dlq":                        "peril_dlq",
+		"rpc.join":                         "rpc.join",
+		"moves.retry.soon":                 "moves.retry.soon",
+		"lobby.server-main":                "lobby.server-main",
+	}
+	for name, want := range tests {
+		if got := metricName(name); got != want {
+			t.Errorf("metricName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestMetricsLabelsStayBounded(t *testing.T) {
+	reg := metrics.NewRegistry()
+	m := NewMetrics(reg)
+	b := newTestBroker(t)
+	b.SetMetrics(m)
+	ctx := context.Background()
+
+	handled := make(chan struct{}, 10)
+	var replyQueues []string
+	for i := 0; i < 3; i++ {
+		queue := rpcReplyPrefix + NewMessageID()
+		replyQueues = append(replyQueues, queue)
+		_, err := b.Subscribe(ctx, routing.ExchangePerilDirect, queue, queue, SimpleQueueTransient, func(Delivery) AckType {
+			handled <- struct{}{}
+			return Ack
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, queue := range replyQueues {
+		if err := b.Publish(ctx, "", queue, Message{Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, handled)
+	}
+	for _, delay := range []string{"1000ms", "2000ms"} {
+		if err := b.Publish(ctx, "", "game_logs.retry."+delay, Message{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := m.published.With("", "rpc.reply.*", "ok").Value(); got != 3 {
+		t.Errorf("published to rpc.reply.* = %v, want 3", got)
+	}
+	if got := m.published.With("", "game_logs.retry.*", "ok").Value(); got != 2 {
+		t.Errorf("published to game_logs.retry.* = %v, want 2", got)
+	}
+	// The handler has returned, but the middleware counts after it
+	for deadline := time.Now().Add(time.Second); m.consumed.With("rpc.reply.*", "ack").Value() < 3 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if got := m.consumed.With("rpc.reply.*", "ack").Value(); got != 3 {
+		t.Errorf("consumed from rpc.reply.* = %v, want 3", got)
+	}
+	if got := m.lag.With("rpc.reply.*").Count(); got != 3 {
+		t.Errorf("lag observed for rpc.reply.* %d times, want 3", got)
+	}
+
+	var text strings.Builder
+	if err := reg.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	for _, queue := range replyQueues {
+		if strings.Contains(text.String(), queue) {
+			t.Fatalf("reply queue %s has its own series:\n%s", queue, text.String())
+		}
+	}
+	if strings.Contains(text.String(), "1000ms") {
+		t.Fatalf("retry delay has its own series:\n%s", text.String())
+	}
+}
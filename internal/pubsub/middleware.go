@@ -0,0 +1,87 @@
+package pubsub
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a subscription's handler, much like HTTP middleware.
+type Middleware func(next func(Delivery) AckType) func(Delivery) AckType
+
+// WithMiddleware wraps the handler in mw, the first one outermost. Calling it
+// more than once adds to the chain. Typed subscriptions decode inside the
+// chain, so middleware sees every delivery, including undecodable ones.
+func WithMiddleware(mw ...Middleware) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.middleware = append(o.middleware, mw...)
+	}
+}
+
+func chain(handler func(Delivery) AckType, mw []Middleware) func(Delivery) AckType {
+	for i := len(mw) - 1; i >= 0; i-- {
+		handler = mw[i](handler)
+	}
+	return handler
+}
+
+// Recover turns a panicking handler into NackDiscard, so the message goes to
+// the queue's dead letter exchange instead of taking the process down.
+func Recover() Middleware {
+	return func(next func(Delivery) AckType) func(Delivery) AckType {
+		return func(d Delivery) (ackType AckType) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger().Error("handler panicked", append(d.logAttrs(),
+						"panic", fmt.Sprint(r),
+						"stack", string(debug.Stack()),
+					)...)
+					ackType = NackDiscard
+				}
+			}()
+			return next(d)
+		}
+	}
+}
+
+// Logging logs each delivery at debug level once it has been handled.
+func Logging() Middleware {
+	return func(next func(Delivery) AckType) func(Delivery) AckType {
+		return func(d Delivery) AckType {
+			start := time.Now()
+			ackType := next(d)
+			logger().Debug("handled message", append(d.logAttrs(),
+				"ack", ackType.String(),
+				"duration", time.Since(start),
+			)...)
+			return ackType
+		}
+	}
+}
+
+// Timing calls observe with how long the rest of the chain took.
+func Timing(observe func(d Delivery, ackType AckType, took time.Duration)) Middleware {
+	return func(next func(Delivery) AckType) func(Delivery) AckType {
+		return func(d Delivery) AckType {
+			start := time.Now()
+			ackType := next(d)
+			observe(d, ackType, time.Since(start))
+			return ackType
+		}
+	}
+}
+
+// Authorize only lets deliveries that pass check reach the handler. The rest
+// are discarded, which dead-letters them if the queue has a dead letter
+// exchange.
+func Authorize(check func(Delivery) error) Middleware {
+	return func(next func(Delivery) AckType) func(Delivery) AckType {
+		return func(d Delivery) AckType {
+			if err := check(d); err != nil {
+				logger().Warn("rejected message", append(d.logAttrs(), "err", err)...)
+				return NackDiscard
+			}
+			return next(d)
+		}
+	}
+}
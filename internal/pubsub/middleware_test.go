@@ -0,0 +1,45 @@
+package pubsub
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRecover(t *testing.T) {
+	handler := chain(func(d Delivery) AckType {
+		if string(d.Body) == "panic" {
+			panic("handler failed")
+		}
+		return Ack
+	}, []Middleware{Recover()})
+
+	if got := handler(Delivery{Message: Message{Body: []byte("panic")}}); got != NackDiscard {
+		t.Fatalf("panicking handler settled with %s, want %s", got, NackDiscard)
+	}
+	if got := handler(Delivery{}); got != Ack {
+		t.Fatalf("handler settled with %s after a panic, want %s", got, Ack)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	called := 0
+	handler := chain(func(Delivery) AckType {
+		called++
+		return Ack
+	}, []Middleware{Authorize(func(d Delivery) error {
+		if d.RoutingKey != "allowed" {
+			return errors.New("not allowed")
+		}
+		return nil
+	})})
+
+	if got := handler(Delivery{RoutingKey: "refused"}); got != NackDiscard {
+		t.Fatalf("refused delivery settled with %s, want %s", got, NackDiscard)
+	}
+	if called != 0 {
+		t.Fatal("refused delivery reached the handler")
+	}
+	if got := handler(Delivery{RoutingKey: "allowed"}); got != Ack || called != 1 {
+		t.Fatalf("allowed delivery settled with %s after %d calls, want %s after 1", got, called, Ack)
+	}
+}
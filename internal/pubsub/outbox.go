@@ -0,0 +1,237 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// OutboxConfig controls how an Outbox relays its messages.
+type OutboxConfig struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Undeliverable, if set, is called from the relay for a mandatory
+	// message the broker reported as unroutable. Such messages are
+	// marked sent rather than retried, since retrying wouldn't route them.
+	Undeliverable func(Envelope, *UnroutableError)
+}
+
+func DefaultOutboxConfig() OutboxConfig {
+	return OutboxConfig{
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+	}
+}
+
+// Outbox stores outgoing messages in an append-only file before they are
+// published, so a message recorded alongside a state change is published
+// eventually even if the broker is down or the process restarts. A relay
+// goroutine publishes stored messages in order and marks each sent once
+// the broker has accepted it; with publisher confirms that means the
+// broker has taken responsibility for it. A crash between publishing and
+// marking sends the message again on the next open, so consumers should
+// deduplicate by message ID. Header values are stored as JSON and come
+// back as JSON types. The file is compacted each time it is opened, and
+// whenever it has grown well past what is still pending.
+type Outbox struct {
+	pub    Publisher
+	config OutboxConfig
+	cancel context.CancelFunc
+	done   chan struct{}
+	// wake nudges the relay when a message is added
+	wake chan struct{}
+
+	mu      sync.Mutex
+	log     *appendLog
+	pending []Envelope
+}
+
+type outboxRecord struct {
+	Add  *Envelope `json:"add,omitempty"`
+	Sent string    `json:"sent,omitempty"`
+}
+
+// OpenOutbox opens or creates the outbox at path and starts relaying its
+// messages to pub until ctx is cancelled or the outbox is closed.
+func OpenOutbox(ctx context.Context, path string, pub Publisher, config OutboxConfig) (*Outbox, error) {
+	o := &Outbox{
+		pub:    pub,
+		config: config,
+		done:   make(chan struct{}),
+		wake:   make(chan struct{}, 1),
+	}
+	err := readAppendLog(path, "outbox", func(record outboxRecord) {
+		switch {
+		case record.Add != nil:
+			o.pending = append(o.pending, *record.Add)
+		case record.Sent != "":
+			o.remove(record.Sent)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if o.log, err = createAppendLog(path, "outbox", o.records()); err != nil {
+		return nil, err
+	}
+
+	ctx, o.cancel = context.WithCancel(ctx)
+	go o.relay(ctx)
+	return o, nil
+}
+
+// Add stores msg for publishing to exchange with key. The message is on
+// disk by the time Add returns, and is given an ID first if it hasn't one.
+func (o *Outbox) Add(exchange, key string, msg Message) error {
+	if msg.MessageID == "" {
+		msg.MessageID = NewMessageID()
+	}
+	m := Envelope{Exchange: exchange, Key: key, Message: msg}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.log.append(outboxRecord{Add: &m}, true); err != nil {
+		return err
+	}
+	o.pending = append(o.pending, m)
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Enqueue encodes val the way Publish does and adds it to the outbox. The
+// message carries the trace context of an enqueue span, so its consumers
+// are traced back to the state change that produced it rather than to the
+// relay.
+func Enqueue[T any](ctx context.Context, o *Outbox, exchange, key string, val T, opts ...PublishOption) error {
+	msg, err := newMessage(ctx, val, opts)
+	if err != nil {
+		return err
+	}
+
+	_, span := startPublishSpan(ctx, exchange+" enqueue", exchange, key, &msg)
+	defer span.End()
+	err = o.Add(exchange, key, msg)
+	span.RecordError(err)
+	return err
+}
+
+// Pending returns how many messages haven't been published yet.
+func (o *Outbox) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// Close stops the relay and closes the file. Messages still pending are
+// published after the outbox is next opened.
+func (o *Outbox) Close() error {
+	o.cancel()
+	<-o.done
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.log.close()
+}
+
+func (o *Outbox) relay(ctx context.Context) {
+	defer close(o.done)
+
+	backoff := o.config.InitialBackoff
+	for {
+		m, ok := o.next()
+		if !ok {
+			select {
+			case <-o.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		err := o.pub.Publish(ctx, m.Exchange, m.Key, copyMessage(m.Message))
+		var unroutable *UnroutableError
+		if errors.As(err, &unroutable) {
+			logger().Warn("outbox message was unroutable",
+				"exchange", m.Exchange,
+				"routing_key", m.Key,
+				"message_id", m.Message.MessageID,
+			)
+			if o.config.Undeliverable != nil {
+				o.config.Undeliverable(m, unroutable)
+			}
+			err = nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger().Error("couldn't relay outbox message",
+				"exchange", m.Exchange,
+				"routing_key", m.Key,
+				"message_id", m.Message.MessageID,
+				"err", err,
+			)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = nextBackoff(backoff, o.config.MaxBackoff)
+			continue
+		}
+		backoff = o.config.InitialBackoff
+
+		if err := o.markSent(m.Message.MessageID); err != nil {
+			// It will be sent again after a restart, which consumers
+			// deduplicate
+			logger().Error("couldn't mark outbox message sent",
+				"message_id", m.Message.MessageID,
+				"err", err,
+			)
+		}
+	}
+}
+
+func (o *Outbox) next() (Envelope, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.pending) == 0 {
+		return Envelope{}, false
+	}
+	return o.pending[0], true
+}
+
+func (o *Outbox) markSent(id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.remove(id)
+	if o.log.needsRewrite(len(o.pending)) {
+		return o.log.rewrite(o.records())
+	}
+	// Losing this to a crash only means sending the message twice
+	return o.log.append(outboxRecord{Sent: id}, false)
+}
+
+// records are what the outbox's file needs to hold: a record for each
+// pending message.
+func (o *Outbox) records() []any {
+	records := make([]any, len(o.pending))
+	for i := range o.pending {
+		records[i] = outboxRecord{Add: &o.pending[i]}
+	}
+	return records
+}
+
+func (o *Outbox) remove(id string) {
+	for i, m := range o.pending {
+		if m.Message.MessageID == id {
+			o.pending = append(o.pending[:i], o.pending[i+1:]...)
+			return
+		}
+	}
+}
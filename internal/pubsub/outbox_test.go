@@ -0,0 +1,176 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyPublisher fails the attempts fail returns an error for, counting
+// from 0, and sends the rest on published.
+type flakyPublisher struct {
+	fail      func(attempt int) error
+	published chan Envelope
+
+	mu       sync.Mutex
+	attempts []time.Time
+}
+
+func newFlakyPublisher(fail func(attempt int) error) *flakyPublisher {
+	return &flakyPublisher{fail: fail, published: make(chan Envelope, 100)}
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	p.mu.Lock()
+	attempt := len(p.attempts)
+	p.attempts = append(p.attempts, time.Now())
+	p.mu.Unlock()
+	if p.fail != nil {
+		if err := p.fail(attempt); err != nil {
+			return err
+		}
+	}
+	p.published <- Envelope{Exchange: exchange, Key: key, Message: msg}
+	return nil
+}
+
+var errBrokerDown = errors.New("broker is down")
+
+func openTestOutbox(t *testing.T, path string, pub Publisher, config OutboxConfig) *Outbox {
+	t.Helper()
+	o, err := OpenOutbox(context.Background(), path, pub, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// waitForPending waits until o has n messages left to publish.
+func waitForPending(t *testing.T, o *Outbox, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); o.Pending() != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("outbox has %d messages pending, want %d", o.Pending(), n)
+		}
+	}
+}
+
+func TestOutboxResendsAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	down := newFlakyPublisher(func(int) error { return errBrokerDown })
+	o := openTestOutbox(t, path, down, OutboxConfig{InitialBackoff: time.Hour})
+	for _, key := range []string{"army_moves.washington", "war.washington", "game_logs.washington"} {
+		if err := o.Add("peril_topic", key, Message{Body: []byte(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	up := newFlakyPublisher(nil)
+	o = openTestOutbox(t, path, up, DefaultOutboxConfig())
+	for _, want := range []string{"army_moves.washington", "war.washington", "game_logs.washington"} {
+		if m := receive(t, up.published); m.Key != want || string(m.Message.Body) != want || m.Message.MessageID == "" {
+			t.Fatalf("relayed %s with body %q and ID %q, want %s", m.Key, m.Message.Body, m.Message.MessageID, want)
+		}
+	}
+	waitForPending(t, o, 0)
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages marked sent aren't sent again
+	o = openTestOutbox(t, path, down, OutboxConfig{InitialBackoff: time.Hour})
+	defer o.Close()
+	if n := o.Pending(); n != 0 {
+		t.Fatalf("outbox has %d messages pending after they were sent, want 0", n)
+	}
+}
+
+func TestOutboxCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	pub := newFlakyPublisher(nil)
+	o := openTestOutbox(t, path, pub, DefaultOutboxConfig())
+	defer o.Close()
+
+	n := appendLogSlack
+	for i := 0; i < n; i++ {
+		if err := o.Add("peril_topic", "game_logs.washington", Message{}); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, pub.published)
+	}
+	waitForPending(t, o, 0)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		lines++
+	}
+	// Each message is added and marked sent, two lines, and the file is
+	// compacted once it passes the slack
+	if lines >= 2*n || lines != o.log.lines {
+		t.Fatalf("outbox file has %d lines, %d by its count, after %d messages were sent", lines, o.log.lines, n)
+	}
+}
+
+func TestOutboxBacksOff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	pub := newFlakyPublisher(func(attempt int) error {
+		if attempt < 3 {
+			return errBrokerDown
+		}
+		return nil
+	})
+	o := openTestOutbox(t, path, pub, OutboxConfig{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond})
+	defer o.Close()
+
+	if err := o.Add("peril_topic", "army_moves.washington", Message{}); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, pub.published)
+	waitForPending(t, o, 0)
+
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	if len(pub.attempts) != 4 {
+		t.Fatalf("made %d attempts, want 4", len(pub.attempts))
+	}
+	for i, want := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 20 * time.Millisecond} {
+		if gap := pub.attempts[i+1].Sub(pub.attempts[i]); gap < want {
+			t.Errorf("attempt %d came %s after the last, want at least %s", i+2, gap, want)
+		}
+	}
+}
+
+func TestOutboxUnroutable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	pub := newFlakyPublisher(func(int) error {
+		return &UnroutableError{Exchange: "peril_topic", RoutingKey: "war.washington", Reason: "NO_ROUTE"}
+	})
+	undeliverable := make(chan Envelope, 1)
+	o := openTestOutbox(t, path, pub, OutboxConfig{
+		InitialBackoff: time.Hour,
+		Undeliverable:  func(m Envelope, _ *UnroutableError) { undeliverable <- m },
+	})
+	defer o.Close()
+
+	if err := o.Add("peril_topic", "war.washington", Message{Mandatory: true}); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, undeliverable); m.Key != "war.washington" {
+		t.Fatalf("%s reported undeliverable, want war.washington", m.Key)
+	}
+	// Retrying wouldn't route it, so it counts as sent
+	waitForPending(t, o, 0)
+}
@@ -0,0 +1,137 @@
+package pubsub
+
+import (
+	"context"
+)
+
+type DecodeFailureAction int
+
+const (
+	// DecodeFailureDeadLetter republishes the undecodable message to the
+	// policy's exchange with headers describing the failure.
+	DecodeFailureDeadLetter DecodeFailureAction = iota
+	// DecodeFailureDiscard acknowledges and drops the message.
+	DecodeFailureDiscard
+	// DecodeFailureRequeue puts the message back on its queue up to
+	// MaxRequeues times before dead-lettering it.
+	DecodeFailureRequeue
+)
+
+const (
+	HeaderDecodeError         = "x-decode-error"
+	HeaderDecodeAttempts      = "x-decode-attempts"
+	HeaderOriginalContentType = "x-original-content-type"
+	HeaderOriginalExchange    = "x-original-exchange"
+	HeaderOriginalRoutingKey  = "x-original-routing-key"
+	HeaderOriginalQueue       = "x-original-queue"
+)
+
+// DecodeFailurePolicy decides what happens to a message whose body can't be
+// decoded. Dead-lettered messages keep their raw body untouched.
+type DecodeFailurePolicy struct {
+	Action DecodeFailureAction
+	// Exchange receives dead-lettered messages. Empty means the
+	// subscription's dead letter exchange, peril_dlx by default; with none
+	// the message is rejected to the queue's own dead-lettering.
+	Exchange    string
+	MaxRequeues int
+}
+
+func DefaultDecodeFailurePolicy() DecodeFailurePolicy {
+	return DecodeFailurePolicy{
+		Action: DecodeFailureDeadLetter,
+	}
+}
+
+func WithDecodeFailurePolicy(policy DecodeFailurePolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.decodeFailure = policy
+	}
+}
+
+// handle settles a message that failed to decode. Dead-lettering and
+// requeueing republish a copy, so pub must be able to reach the broker the
+// message came from; without one the queue's own dead letter exchange is
+// used instead and the failure headers are lost.
+func (p DecodeFailurePolicy) handle(pub Publisher, deadLetterExchange, queueName string, d Delivery, decodeErr error) AckType {
+	if p.Action == DecodeFailureDiscard {
+		return Ack
+	}
+	if pub == nil {
+		return NackDiscard
+	}
+
+	msg := copyMessage(d.Message)
+	if msg.Headers == nil {
+		msg.Headers = map[string]any{}
+	}
+	attempts := intValue(msg.Headers[HeaderDecodeAttempts]) + 1
+	msg.Headers[HeaderDecodeAttempts] = int64(attempts)
+	msg.Headers[HeaderDecodeError] = decodeErr.Error()
+	msg.Headers[HeaderOriginalContentType] = d.ContentType
+	msg.Headers[HeaderOriginalQueue] = queueName
+	if _, ok := msg.Headers[HeaderOriginalExchange]; !ok {
+		msg.Headers[HeaderOriginalExchange] = d.Exchange
+		msg.Headers[HeaderOriginalRoutingKey] = d.RoutingKey
+	}
+
+	var err error
+	if p.Action == DecodeFailureRequeue && attempts <= p.MaxRequeues {
+		// The default exchange routes by queue name, so only this queue
+		// sees the retry rather than everything bound to the original key.
+		err = pub.Publish(context.Background(), "", queueName, msg)
+	} else {
+		exchange := p.Exchange
+		if exchange == "" {
+			exchange = deadLetterExchange
+		}
+		if exchange == "" {
+			// Leave it to the queue, which dead-letters it by its own key
+			// or drops it
+			return NackDiscard
+		}
+		key, _ := msg.Headers[HeaderOriginalRoutingKey].(string)
+		err = pub.Publish(context.Background(), exchange, key, msg)
+	}
+	if err != nil {
+		logger().Error("couldn't republish undecodable message", append(d.logAttrs(), "err", err)...)
+		return NackDiscard
+	}
+	return Ack
+}
+
+func isInt(v any) bool {
+	switch v.(type) {
+	case int, int8, int16, int32, int64, uint8, uint16, uint32, uint64:
+		return true
+	default:
+		return false
+	}
+}
+
+// intValue reads an integer header or queue argument, which may come back
+// from the broker as any of the AMQP integer types.
+func intValue(v any) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int8:
+		return int(n)
+	case int16:
+		return int(n)
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case uint8:
+		return int(n)
+	case uint16:
+		return int(n)
+	case uint32:
+		return int(n)
+	case uint64:
+		return int(n)
+	default:
+		return 0
+	}
+}
@@ -1,36 +1,161 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
 	"fmt"
+	"time"
 
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/tracing"
 )
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	data, err := json.Marshal(val)
+type publishOptions struct {
+	codec Codec
+	// msg carries everything but the body and content type, which come
+	// from the codec
+	msg Message
+	// limit, if set, is called before publishing and may delay or refuse it
+	limit func(ctx context.Context) error
+}
+
+type PublishOption func(*publishOptions)
+
+func WithCodec(codec Codec) PublishOption {
+	return func(o *publishOptions) {
+		o.codec = codec
+	}
+}
+
+// WithMandatory makes an unroutable message fail with *UnroutableError.
+// Over AMQP this is only detected when publisher confirms are enabled.
+func WithMandatory() PublishOption {
+	return func(o *publishOptions) {
+		o.msg.Mandatory = true
+	}
+}
+
+// WithMessageID replaces the random ID Publish gives each message.
+func WithMessageID(id string) PublishOption {
+	return func(o *publishOptions) {
+		o.msg.MessageID = id
+	}
+}
+
+// WithCorrelationID ties a message to the one that caused it, usually by
+// that message's ID.
+func WithCorrelationID(id string) PublishOption {
+	return func(o *publishOptions) {
+		o.msg.CorrelationID = id
+	}
+}
+
+// WithReplyTo names the queue a response should be sent to. Call sets it
+// for you.
+func WithReplyTo(queueName string) PublishOption {
+	return func(o *publishOptions) {
+		o.msg.ReplyTo = queueName
+	}
+}
+
+// WithPriority sets the message's priority, which only matters to queues
+// declared with WithMaxPriority. Priorities above the queue's maximum are
+// treated as the maximum.
+func WithPriority(priority uint8) PublishOption {
+	return func(o *publishOptions) {
+		o.msg.Priority = priority
+	}
+}
+
+func WithAppID(id string) PublishOption {
+	return func(o *publishOptions) {
+		o.msg.AppID = id
+	}
+}
+
+// WithPublisher records who published the message in HeaderPublisher.
+func WithPublisher(name string) PublishOption {
+	return WithHeader(HeaderPublisher, name)
+}
+
+func WithHeader(key string, value any) PublishOption {
+	return func(o *publishOptions) {
+		if o.msg.Headers == nil {
+			o.msg.Headers = map[string]any{}
+		}
+		o.msg.Headers[key] = value
+	}
+}
+
+// Publish encodes val with the codec from WithCodec, JSON by default. The
+// message carries the trace context of a new span, which is a child of the
+// span in ctx if there is one.
+func Publish[T any](ctx context.Context, pub Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	msg, err := newMessage(ctx, val, opts)
 	if err != nil {
-		return fmt.Errorf("couldn't marshal message into JSON: %w", err)
+		return err
 	}
 
-	return ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
-		ContentType: "application/json",
-		Body:        data,
-	})
+	ctx, span := startPublishSpan(ctx, exchange+" publish", exchange, key, &msg)
+	defer span.End()
+	err = pub.Publish(ctx, exchange, key, msg)
+	span.RecordError(err)
+	return err
 }
 
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	var buf bytes.Buffer
-	encoder := gob.NewEncoder(&buf)
-	if err := encoder.Encode(val); err != nil {
-		return fmt.Errorf("couldn't encode message into gob: %w", err)
+// newMessage applies opts and encodes val, waiting on any rate limit first.
+func newMessage[T any](ctx context.Context, val T, opts []PublishOption) (Message, error) {
+	o := publishOptions{codec: JSON}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.limit != nil {
+		if err := o.limit(ctx); err != nil {
+			return Message{}, err
+		}
+	}
+
+	data, err := o.codec.Marshal(val)
+	if err != nil {
+		return Message{}, fmt.Errorf("couldn't encode message as %s: %w", o.codec.ContentType(), err)
+	}
+
+	msg := o.msg
+	if msg.MessageID == "" {
+		msg.MessageID = NewMessageID()
 	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	msg.ContentType = o.codec.ContentType()
+	msg.Body = data
+	return msg, nil
+}
+
+// startPublishSpan starts a span for sending msg and records its trace
+// context in msg's headers.
+func startPublishSpan(ctx context.Context, name, exchange, key string, msg *Message) (context.Context, *tracing.Span) {
+	ctx, span := tracing.Start(ctx, tracing.SpanContext{}, name)
+	span.SetAttribute("messaging.destination", exchange)
+	span.SetAttribute("messaging.routing_key", key)
+	span.SetAttribute("messaging.message_id", msg.MessageID)
+	if msg.Headers == nil {
+		msg.Headers = map[string]any{}
+	}
+	msg.Headers[tracing.TraceParentHeader] = span.SpanContext().TraceParent()
+	return ctx, span
+}
+
+func PublishJSON[T any](pub Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return PublishJSONWithContext(context.Background(), pub, exchange, key, val, opts...)
+}
+
+func PublishJSONWithContext[T any](ctx context.Context, pub Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(ctx, pub, exchange, key, val, append(opts, WithCodec(JSON))...)
+}
+
+func PublishGob[T any](pub Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return PublishGobWithContext(context.Background(), pub, exchange, key, val, opts...)
+}
 
-	return ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
-		ContentType: "application/gob",
-		Body:        buf.Bytes(),
-	})
+func PublishGobWithContext[T any](ctx context.Context, pub Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(ctx, pub, exchange, key, val, append(opts, WithCodec(Gob))...)
 }
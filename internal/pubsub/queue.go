@@ -0,0 +1,193 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type QueueType string
+
+const (
+	QueueTypeClassic QueueType = "classic"
+	// QueueTypeQuorum is replicated across the cluster. Quorum queues are
+	// always durable and can't be exclusive, auto-deleted, lazy or
+	// prioritised.
+	QueueTypeQuorum QueueType = "quorum"
+)
+
+// Overflow is what a queue at its maximum length does with another message.
+type Overflow string
+
+const (
+	// OverflowDropHead drops or dead-letters the oldest message
+	OverflowDropHead Overflow = "drop-head"
+	// OverflowRejectPublish refuses the new message; with publisher
+	// confirms Publish fails with ErrPublishNacked
+	OverflowRejectPublish Overflow = "reject-publish"
+	// OverflowRejectPublishDLX refuses the new message and dead-letters it
+	OverflowRejectPublishDLX Overflow = "reject-publish-dlx"
+)
+
+// QueueOptions is everything a queue is declared with. The zero value is a
+// classic, non-durable queue that is kept until it is deleted.
+type QueueOptions struct {
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	// Type is classic when empty
+	Type QueueType
+
+	// MessageTTL expires messages that have waited this long
+	MessageTTL time.Duration
+	// Expires deletes the queue once it has gone this long unused
+	Expires time.Duration
+
+	// MaxLength and MaxLengthBytes limit the ready messages, counting
+	// bodies only for bytes. Overflow decides what happens past either.
+	MaxLength      int
+	MaxLengthBytes int
+	// Overflow is drop-head when empty
+	Overflow Overflow
+
+	// SingleActiveConsumer delivers to one consumer at a time, with the
+	// rest standing by to take over, so the queue is handled in order.
+	SingleActiveConsumer bool
+	// Lazy keeps a classic queue's messages on disk rather than in memory.
+	Lazy bool
+	// MaxPriority makes it a priority queue; see WithMaxPriority.
+	MaxPriority uint8
+
+	// DeadLetterExchange is where rejected and expired messages go. With
+	// only DeadLetterRoutingKey set they go through the default exchange,
+	// straight to the queue of that name.
+	DeadLetterExchange string
+	// DeadLetterRoutingKey replaces the key messages were published with
+	// when they are dead-lettered.
+	DeadLetterRoutingKey string
+}
+
+// QueueOptions is the queue each SimpleQueueType stands for: durable, or
+// exclusive to its connection and deleted with its last consumer.
+func (t SimpleQueueType) QueueOptions() QueueOptions {
+	if t == SimpleQueueDurable {
+		return QueueOptions{Durable: true}
+	}
+	return QueueOptions{AutoDelete: true, Exclusive: true}
+}
+
+// Validate reports every setting the broker would refuse, or that
+// contradicts another.
+func (o QueueOptions) Validate() error {
+	var errs []error
+
+	switch o.Type {
+	case "", QueueTypeClassic:
+	case QueueTypeQuorum:
+		if !o.Durable {
+			errs = append(errs, errors.New("quorum queues must be durable"))
+		}
+		if o.Exclusive {
+			errs = append(errs, errors.New("quorum queues can't be exclusive"))
+		}
+		if o.AutoDelete {
+			errs = append(errs, errors.New("quorum queues can't be auto-deleted"))
+		}
+		if o.Lazy {
+			errs = append(errs, errors.New("quorum queues can't be lazy"))
+		}
+		if o.MaxPriority > 0 {
+			errs = append(errs, errors.New("quorum queues can't have a maximum priority"))
+		}
+		if o.Overflow == OverflowRejectPublishDLX {
+			errs = append(errs, fmt.Errorf("quorum queues don't support %s overflow", o.Overflow))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown queue type %q, expected classic or quorum", o.Type))
+	}
+
+	if o.MessageTTL < 0 {
+		errs = append(errs, fmt.Errorf("message TTL can't be negative, got %s", o.MessageTTL))
+	} else if o.MessageTTL > 0 && o.MessageTTL < time.Millisecond {
+		errs = append(errs, fmt.Errorf("message TTL must be at least 1ms, got %s", o.MessageTTL))
+	}
+	if o.Expires < 0 {
+		errs = append(errs, fmt.Errorf("queue expiry can't be negative, got %s", o.Expires))
+	} else if o.Expires > 0 && o.Expires < time.Millisecond {
+		errs = append(errs, fmt.Errorf("queue expiry must be at least 1ms, got %s", o.Expires))
+	}
+
+	if o.MaxLength < 0 {
+		errs = append(errs, fmt.Errorf("max length can't be negative, got %d", o.MaxLength))
+	}
+	if o.MaxLengthBytes < 0 {
+		errs = append(errs, fmt.Errorf("max length in bytes can't be negative, got %d", o.MaxLengthBytes))
+	}
+	switch o.Overflow {
+	case "", OverflowDropHead, OverflowRejectPublish, OverflowRejectPublishDLX:
+	default:
+		errs = append(errs, fmt.Errorf("unknown overflow %q, expected drop-head, reject-publish or reject-publish-dlx", o.Overflow))
+	}
+	if o.Overflow != "" && o.MaxLength == 0 && o.MaxLengthBytes == 0 {
+		errs = append(errs, errors.New("overflow needs a max length"))
+	}
+	if o.Overflow == OverflowRejectPublishDLX && o.DeadLetterExchange == "" && o.DeadLetterRoutingKey == "" {
+		errs = append(errs, fmt.Errorf("%s overflow needs somewhere to dead-letter to", o.Overflow))
+	}
+
+	if o.SingleActiveConsumer && o.Exclusive {
+		errs = append(errs, errors.New("exclusive queues only have one consumer, so single active consumer means nothing"))
+	}
+	return errors.Join(errs...)
+}
+
+// argsWith is the queue's arguments together with extra ones, which the
+// settings above take precedence over.
+func (o QueueOptions) argsWith(extra map[string]any) map[string]any {
+	args := o.Args()
+	for k, v := range extra {
+		if _, ok := args[k]; !ok {
+			args[k] = v
+		}
+	}
+	return args
+}
+
+// Args are the x- arguments the queue is declared with.
+func (o QueueOptions) Args() map[string]any {
+	args := map[string]any{}
+	if o.Type != "" {
+		args["x-queue-type"] = string(o.Type)
+	}
+	if o.MessageTTL > 0 {
+		args["x-message-ttl"] = o.MessageTTL.Milliseconds()
+	}
+	if o.Expires > 0 {
+		args["x-expires"] = o.Expires.Milliseconds()
+	}
+	if o.MaxLength > 0 {
+		args["x-max-length"] = int64(o.MaxLength)
+	}
+	if o.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = int64(o.MaxLengthBytes)
+	}
+	if o.Overflow != "" {
+		args["x-overflow"] = string(o.Overflow)
+	}
+	if o.SingleActiveConsumer {
+		args["x-single-active-consumer"] = true
+	}
+	if o.Lazy {
+		args["x-queue-mode"] = "lazy"
+	}
+	if o.MaxPriority > 0 {
+		args["x-max-priority"] = int64(o.MaxPriority)
+	}
+	if o.DeadLetterExchange != "" || o.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-exchange"] = o.DeadLetterExchange
+	}
+	if o.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = o.DeadLetterRoutingKey
+	}
+	return args
+}
@@ -0,0 +1,228 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned by Publish for a message over its rate limit
+// that was dropped rather than delayed.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// RateLimitAction decides what happens to a message over its rate limit.
+type RateLimitAction int
+
+const (
+	// RateLimitDelay waits for the bucket to refill before going on.
+	RateLimitDelay RateLimitAction = iota
+	// RateLimitDrop discards the message: subscriptions acknowledge it and
+	// Publish returns ErrRateLimited.
+	RateLimitDrop
+	// RateLimitDeadLetter rejects the message to the queue's dead letter
+	// exchange. Publishers have nowhere to dead-letter to, so they drop it.
+	RateLimitDeadLetter
+)
+
+func (a RateLimitAction) String() string {
+	switch a {
+	case RateLimitDelay:
+		return "delay"
+	case RateLimitDrop:
+		return "drop"
+	case RateLimitDeadLetter:
+		return "dead-letter"
+	default:
+		return fmt.Sprintf("RateLimitAction(%d)", int(a))
+	}
+}
+
+// ParseRateLimitAction reads "delay", "drop" or "dead-letter".
+func ParseRateLimitAction(s string) (RateLimitAction, error) {
+	for _, a := range []RateLimitAction{RateLimitDelay, RateLimitDrop, RateLimitDeadLetter} {
+		if a.String() == s {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown rate limit action %q, expected delay, drop or dead-letter", s)
+}
+
+// RateLimiter keeps a token bucket per key, such as a player, and counts
+// how often each key went over its limit.
+type RateLimiter struct {
+	rate  float64
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	stats  Throttled
+}
+
+// Throttled is how often one key went over its limit.
+type Throttled struct {
+	Key          string
+	Delayed      int
+	Dropped      int
+	DeadLettered int
+	// Last is when the key last went over its limit
+	Last time.Time
+}
+
+// NewRateLimiter allows each key rate messages per second on average, and
+// bursts of up to burst at once. rate must be positive.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: map[string]*bucket{},
+	}
+}
+
+// take spends a token from key's bucket. If none is left it returns how
+// long until one will be; with reserve the token is spent anyway, so
+// callers that wait that long queue up behind each other.
+func (l *RateLimiter) take(key string, reserve bool) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.burst), last: now, stats: Throttled{Key: key}}
+		l.buckets[key] = b
+	}
+	b.tokens = min(float64(l.burst), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	if reserve {
+		b.tokens--
+	}
+	return wait
+}
+
+func (l *RateLimiter) record(key string, action RateLimitAction) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.buckets[key]
+	b.stats.Last = time.Now()
+	switch action {
+	case RateLimitDelay:
+		b.stats.Delayed++
+	case RateLimitDrop:
+		b.stats.Dropped++
+	case RateLimitDeadLetter:
+		b.stats.DeadLettered++
+	}
+}
+
+// Throttled lists the keys that have gone over their limit, by key.
+func (l *RateLimiter) Throttled() []Throttled {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var throttled []Throttled
+	for _, b := range l.buckets {
+		if !b.stats.Last.IsZero() {
+			throttled = append(throttled, b.stats)
+		}
+	}
+	sort.Slice(throttled, func(i, j int) bool {
+		return throttled[i].Key < throttled[j].Key
+	})
+	return throttled
+}
+
+// wait applies action to one message for key, sleeping until ctx is done
+// at the longest.
+func (l *RateLimiter) wait(ctx context.Context, key string, action RateLimitAction) error {
+	wait := l.take(key, action == RateLimitDelay)
+	if wait == 0 {
+		return nil
+	}
+	l.record(key, action)
+	if action != RateLimitDelay {
+		return fmt.Errorf("%s: %w", key, ErrRateLimited)
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WithRateLimit makes Publish take a token from l's bucket for key first,
+// applying action when there isn't one. RateLimitDeadLetter drops the
+// message, and is counted as dropped.
+func WithRateLimit(l *RateLimiter, key string, action RateLimitAction) PublishOption {
+	if action == RateLimitDeadLetter {
+		action = RateLimitDrop
+	}
+	return func(o *publishOptions) {
+		o.limit = func(ctx context.Context) error {
+			return l.wait(ctx, key, action)
+		}
+	}
+}
+
+// RateLimit is middleware that takes a token from l's bucket for the key
+// of each message, applying action when there isn't one. Messages key
+// returns "" for aren't limited. Delayed messages hold their worker while
+// they wait, which also slows delivery of the rest of the queue; ones still
+// waiting when the subscription closes are requeued.
+func RateLimit(l *RateLimiter, key func(Delivery) string, action RateLimitAction) Middleware {
+	return func(next func(Delivery) AckType) func(Delivery) AckType {
+		return func(d Delivery) AckType {
+			k := key(d)
+			if k == "" {
+				return next(d)
+			}
+			err := l.wait(d.context(), k, action)
+			switch {
+			case err == nil:
+				return next(d)
+			case !errors.Is(err, ErrRateLimited):
+				return NackRequeue
+			case action == RateLimitDeadLetter:
+				logger().Info("dead-lettering message over rate limit", append(d.logAttrs(), "key", k)...)
+				return NackDiscard
+			default:
+				logger().Info("dropping message over rate limit", append(d.logAttrs(), "key", k)...)
+				return Ack
+			}
+		}
+	}
+}
+
+// BodyKey returns a key function for RateLimit or Dedup that decodes the
+// message body as T and passes it to key. Bodies with no content type are
+// decoded with fallback; ones that can't be decoded get no key.
+func BodyKey[T any](fallback Codec, key func(T) string) func(Delivery) string {
+	return func(d Delivery) string {
+		val, err := decode[T](DefaultCodecs, fallback, d)
+		if err != nil {
+			return ""
+		}
+		return key(val)
+	}
+}
@@ -0,0 +1,88 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestPublishRateLimitDeadLetterDrops(t *testing.T) {
+	b := newTestBroker(t)
+	limiter := NewRateLimiter(0.001, 1)
+	limit := WithRateLimit(limiter, "washington", RateLimitDeadLetter)
+
+	if err := Publish(context.Background(), b, routing.ExchangePerilTopic, "game_logs.washington", "first", limit); err != nil {
+		t.Fatal(err)
+	}
+	err := Publish(context.Background(), b, routing.ExchangePerilTopic, "game_logs.washington", "second", limit)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("publish over the limit returned %v, want %v", err, ErrRateLimited)
+	}
+
+	throttled := limiter.Throttled()
+	want := Throttled{Key: "washington", Dropped: 1}
+	if len(throttled) != 1 {
+		t.Fatalf("throttled = %+v, want just washington", throttled)
+	}
+	throttled[0].Last = want.Last
+	if throttled[0] != want {
+		t.Fatalf("throttled = %+v, want %+v", throttled[0], want)
+	}
+}
+
+func TestRateLimitMiddlewareDeadLetters(t *testing.T) {
+	limiter := NewRateLimiter(0.001, 1)
+	handle := RateLimit(limiter, func(Delivery) string { return "washington" }, RateLimitDeadLetter)(
+		func(Delivery) AckType { return Ack },
+	)
+
+	if got := handle(Delivery{}); got != Ack {
+		t.Fatalf("first message settled with %v, want %v", got, Ack)
+	}
+	if got := handle(Delivery{}); got != NackDiscard {
+		t.Fatalf("message over the limit settled with %v, want %v", got, NackDiscard)
+	}
+	if throttled := limiter.Throttled(); len(throttled) != 1 || throttled[0].DeadLettered != 1 || throttled[0].Dropped != 0 {
+		t.Fatalf("throttled = %+v, want one dead-lettered", throttled)
+	}
+}
+
+func TestRateLimitMiddlewareStopsWaitingOnClose(t *testing.T) {
+	b := newTestBroker(t)
+	limiter := NewRateLimiter(0.001, 1)
+	handled := make(chan struct{}, 2)
+	sub, err := b.Subscribe(context.Background(), routing.ExchangePerilDirect, "limited", "limited", SimpleQueueDurable,
+		func(Delivery) AckType {
+			handled <- struct{}{}
+			return Ack
+		},
+		WithMiddleware(RateLimit(limiter, func(Delivery) string { return "washington" }, RateLimitDelay)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := b.Publish(context.Background(), routing.ExchangePerilDirect, "limited", Message{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive(t, handled)
+	for len(limiter.Throttled()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- sub.Close() }()
+	if err := receive(t, closed); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handled:
+		t.Fatal("message waiting for the rate limit was handled after Close")
+	default:
+	}
+	waitForQueue(t, b, "limited", 1)
+}
@@ -0,0 +1,134 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// RetryPolicy limits how often a message can come back through RetryAfter.
+//
+// A retried message is parked in a retry queue named after its queue and
+// delay, e.g. "game_logs.retry.1000ms", whose message TTL is the delay.
+// When it expires RabbitMQ dead-letters it through the default exchange
+// straight back to the queue it came from, rather than to the original
+// exchange, so other queues bound to the same key don't see it twice. Each
+// trip adds to the x-death header, which is what attempts are counted from.
+type RetryPolicy struct {
+	// MaxAttempts is how many times a message may be handled in total
+	// before it is dead-lettered for good. Zero means no limit.
+	MaxAttempts int
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 5,
+	}
+}
+
+func WithRetry(policy RetryPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.retry = policy
+	}
+}
+
+type retryBroker interface {
+	Publisher
+	DeclareQueue(name string, simpleQueueType SimpleQueueType, args map[string]any) error
+}
+
+func retryQueueName(queueName string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%dms", queueName, delay.Milliseconds())
+}
+
+// MaxDelay is the longest a message can wait in a retry or delay queue:
+// RabbitMQ takes a message TTL of at most 2^32-1 milliseconds, about 49
+// days.
+const MaxDelay = (1<<32 - 1) * time.Millisecond
+
+// ErrDelayTooLong is returned for a delay longer than MaxDelay.
+var ErrDelayTooLong = errors.New("delay is longer than the broker allows")
+
+// declareTTLQueue declares a durable queue where messages wait for delay,
+// then are dead-lettered to exchange with key. Retries and delayed
+// publishes each park messages in one per delay.
+func declareTTLQueue(broker retryBroker, name string, delay time.Duration, exchange, key string) error {
+	if delay > MaxDelay {
+		return fmt.Errorf("%s: %w", delay, ErrDelayTooLong)
+	}
+	// Drop the queue once it has sat unused for a while, which the broker
+	// limits the same way as the TTL
+	expires := min(2*delay+time.Minute, MaxDelay)
+	return broker.DeclareQueue(name, SimpleQueueDurable, map[string]any{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-dead-letter-exchange":    exchange,
+		"x-dead-letter-routing-key": key,
+		"x-expires":                 expires.Milliseconds(),
+	})
+}
+
+// scheduleRetry parks d in the retry queue for delay and returns how the
+// original delivery should be settled.
+func (s *Subscription) scheduleRetry(d Delivery, delay time.Duration) AckType {
+	if delay <= 0 {
+		return NackRequeue
+	}
+
+	attempts := retryAttempts(d.Headers, s.queueName) + 1
+	if s.retry.MaxAttempts > 0 && attempts >= s.retry.MaxAttempts {
+		logger().Warn("giving up on message", append(d.logAttrs(), "attempts", attempts)...)
+		return NackDiscard
+	}
+
+	retryQueue := retryQueueName(s.queueName, delay)
+	if err := declareTTLQueue(s.broker, retryQueue, delay, "", s.queueName); err != nil {
+		logger().Error("couldn't declare retry queue", "retry_queue", retryQueue, "err", err)
+		return NackRequeue
+	}
+
+	msg := copyMessage(d.Message)
+	msg.Mandatory = false
+	if msg.Headers == nil {
+		msg.Headers = map[string]any{}
+	}
+	if _, ok := msg.Headers[HeaderOriginalExchange]; !ok {
+		msg.Headers[HeaderOriginalExchange] = d.Exchange
+		msg.Headers[HeaderOriginalRoutingKey] = d.RoutingKey
+	}
+	if err := s.broker.Publish(context.Background(), "", retryQueue, msg); err != nil {
+		logger().Error("couldn't publish to retry queue", append(d.logAttrs(),
+			"retry_queue", retryQueue,
+			"err", err,
+		)...)
+		return NackRequeue
+	}
+	return Ack
+}
+
+// retryAttempts counts how many times a message has expired out of one of
+// queueName's retry queues, according to its x-death header.
+func retryAttempts(headers map[string]any, queueName string) int {
+	deaths, _ := headers["x-death"].([]any)
+	prefix := queueName + ".retry."
+	attempts := 0
+	for _, death := range deaths {
+		var table map[string]any
+		switch t := death.(type) {
+		case amqp.Table:
+			table = t
+		case map[string]any:
+			table = t
+		default:
+			continue
+		}
+		queue, _ := table["queue"].(string)
+		if table["reason"] == "expired" && strings.HasPrefix(queue, prefix) {
+			attempts += intValue(table["count"])
+		}
+	}
+	return attempts
+}
@@ -0,0 +1,106 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRetryAttempts(t *testing.T) {
+	headers := map[string]any{"x-death": []any{
+		amqp.Table{"queue": "game_logs.retry.1000ms", "reason": "expired", "count": int64(2)},
+		map[string]any{"queue": "game_logs.retry.5000ms", "reason": "expired", "count": int32(1)},
+		// Not from one of game_logs' retry queues, or not an expiry
+		amqp.Table{"queue": "army_moves.retry.1000ms", "reason": "expired", "count": int64(4)},
+		amqp.Table{"queue": "game_logs", "reason": "rejected", "count": int64(1)},
+		"garbage",
+	}}
+	if n := retryAttempts(headers, "game_logs"); n != 3 {
+		t.Fatalf("attempts = %d, want 3", n)
+	}
+	if n := retryAttempts(nil, "game_logs"); n != 0 {
+		t.Fatalf("attempts without x-death = %d, want 0", n)
+	}
+}
+
+func TestRetryQueueName(t *testing.T) {
+	if name := retryQueueName("game_logs", 1500*time.Millisecond); name != "game_logs.retry.1500ms" {
+		t.Fatalf("retry queue = %s", name)
+	}
+}
+
+// subscribeRetrying subscribes to queue with a handler that asks to retry
+// after delay until it has seen a message done times, and reports the
+// retry attempts each delivery carried.
+func subscribeRetrying(t *testing.T, b *MemoryBroker, queue string, delay time.Duration, done int, opts ...SubscribeOption) <-chan int {
+	t.Helper()
+	attempts := make(chan int, 10)
+	_, err := b.Subscribe(context.Background(), routing.ExchangePerilDirect, queue, queue, SimpleQueueDurable,
+		func(d Delivery) AckType {
+			n := retryAttempts(d.Headers, queue)
+			attempts <- n
+			if n+1 >= done {
+				return Ack
+			}
+			return RetryAfter(delay)
+		},
+		opts...,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(context.Background(), routing.ExchangePerilDirect, queue, Message{Body: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	return attempts
+}
+
+func TestRetryAfter(t *testing.T) {
+	b := newTestBroker(t)
+	attempts := subscribeRetrying(t, b, "retried", 20*time.Millisecond, 3)
+
+	for want := 0; want < 3; want++ {
+		if n := receive(t, attempts); n != want {
+			t.Fatalf("delivery %d counted %d earlier attempts", want+1, n)
+		}
+	}
+
+	b.mu.Lock()
+	q, ok := b.queues["retried.retry.20ms"]
+	b.mu.Unlock()
+	if !ok {
+		t.Fatal("retry queue wasn't declared")
+	}
+	if !q.durable || intValue(q.args["x-message-ttl"]) != 20 {
+		t.Fatalf("retry queue declared durable=%t with %v, want durable with a 20ms TTL", q.durable, q.args)
+	}
+	if q.args["x-dead-letter-exchange"] != "" || q.args["x-dead-letter-routing-key"] != "retried" {
+		t.Fatalf("retry queue dead-letters with %v, want straight back to retried", q.args)
+	}
+	waitForQueue(t, b, "retried", 0)
+	waitForQueue(t, b, "retried.retry.20ms", 0)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	b := newTestBroker(t)
+	bindDeadLetterQueue(t, b, routing.DeadLetterQueue, routing.ExchangePerilDeadLetter)
+	attempts := subscribeRetrying(t, b, "retried", 10*time.Millisecond, 100, WithRetry(RetryPolicy{MaxAttempts: 3}))
+
+	for want := 0; want < 3; want++ {
+		if n := receive(t, attempts); n != want {
+			t.Fatalf("delivery %d counted %d earlier attempts", want+1, n)
+		}
+	}
+	dead := waitForQueue(t, b, routing.DeadLetterQueue, 1)
+	if n := retryAttempts(dead[0].Headers, "retried"); n != 2 {
+		t.Fatalf("dead-lettered after %d retries, want 2", n)
+	}
+	select {
+	case n := <-attempts:
+		t.Fatalf("handled again after %d retries", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,198 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// HeaderRPCError carries the error a Serve handler returned, in place of a
+// reply body.
+const HeaderRPCError = "x-rpc-error"
+
+// rpcReplyPrefix starts the name of every RPCClient's reply queue.
+const rpcReplyPrefix = "rpc.reply."
+
+// PubSub is what both ends of an RPC need from a broker.
+type PubSub interface {
+	Publisher
+	Subscriber
+}
+
+// RemoteError is returned by Call when the handler on the other end failed.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+// RPCClient owns the reply queue Call waits on. Replies are matched to calls
+// by the request's message ID, which Serve sends back as the correlation ID.
+type RPCClient struct {
+	pub     Publisher
+	replyTo string
+	sub     *Subscription
+
+	mu      sync.Mutex
+	pending map[string]chan Delivery
+}
+
+// NewRPCClient declares a private reply queue and starts listening on it
+// until ctx is cancelled or the client is closed. Replies come through the
+// default exchange, so the queue isn't bound to any other.
+func NewRPCClient(ctx context.Context, broker PubSub, opts ...SubscribeOption) (*RPCClient, error) {
+	c := &RPCClient{
+		pub:     broker,
+		replyTo: rpcReplyPrefix + NewMessageID(),
+		pending: map[string]chan Delivery{},
+	}
+	sub, err := broker.Subscribe(
+		ctx,
+		"",
+		c.replyTo,
+		c.replyTo,
+		SimpleQueueTransient,
+		c.handleReply,
+		opts...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't subscribe to reply queue: %w", err)
+	}
+	c.sub = sub
+	return c, nil
+}
+
+func (c *RPCClient) Close() error {
+	return c.sub.Close()
+}
+
+func (c *RPCClient) handleReply(d Delivery) AckType {
+	c.mu.Lock()
+	replies, ok := c.pending[d.CorrelationID]
+	delete(c.pending, d.CorrelationID)
+	c.mu.Unlock()
+	if !ok {
+		// The call already timed out
+		return Ack
+	}
+	replies <- d
+	return Ack
+}
+
+// Call publishes req to exchange with key and waits up to timeout for the
+// reply. Requests are mandatory, so a call nobody serves fails straight away
+// with *UnroutableError instead of timing out.
+func Call[Req, Resp any](
+	ctx context.Context,
+	c *RPCClient,
+	exchange,
+	key string,
+	req Req,
+	timeout time.Duration,
+	opts ...PublishOption,
+) (Resp, error) {
+	var resp Resp
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	id := NewMessageID()
+	replies := make(chan Delivery, 1)
+	c.mu.Lock()
+	c.pending[id] = replies
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	err := Publish(ctx, c.pub, exchange, key, req, append(
+		opts,
+		WithMessageID(id),
+		WithReplyTo(c.replyTo),
+		WithMandatory(),
+	)...)
+	if err != nil {
+		return resp, fmt.Errorf("couldn't send request: %w", err)
+	}
+
+	select {
+	case d := <-replies:
+		if msg, ok := d.Headers[HeaderRPCError].(string); ok {
+			return resp, &RemoteError{Message: msg}
+		}
+		resp, err = decode[Resp](DefaultCodecs, JSON, d)
+		if err != nil {
+			return resp, fmt.Errorf("couldn't decode reply: %w", err)
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return resp, fmt.Errorf("couldn't get reply: %w", ctx.Err())
+	}
+}
+
+// Serve answers requests sent with Call. The reply uses the request's codec,
+// and an error from handler is sent back to the caller as a *RemoteError.
+// Requests are acknowledged once answered, even if the reply can't be sent,
+// since the caller will have given up by the time a retry got through.
+func Serve[Req, Resp any](
+	ctx context.Context,
+	broker PubSub,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	handler func(Req, Metadata) (Resp, error),
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return SubscribeWithMetadata(
+		ctx,
+		broker,
+		exchange,
+		queueName,
+		key,
+		simpleQueueType,
+		func(req Req, meta Metadata) AckType {
+			resp, err := handler(req, meta)
+			if meta.ReplyTo == "" {
+				// Nobody is waiting to hear about it, but it shouldn't go
+				// unnoticed either
+				if err != nil {
+					logger().Warn("couldn't handle request",
+						"queue", meta.Queue,
+						"routing_key", meta.RoutingKey,
+						"message_id", meta.MessageID,
+						"err", err,
+					)
+				}
+				return Ack
+			}
+
+			codec, ok := DefaultCodecs.Lookup(meta.ContentType)
+			if !ok {
+				codec = JSON
+			}
+			replyOpts := []PublishOption{WithCodec(codec), WithCorrelationID(meta.MessageID)}
+			if err != nil {
+				replyOpts = append(replyOpts, WithHeader(HeaderRPCError, err.Error()))
+			}
+			// The default exchange routes straight to the reply queue
+			if err := Publish(context.Background(), broker, "", meta.ReplyTo, resp, replyOpts...); err != nil {
+				logger().Warn("couldn't send reply",
+					"queue", meta.Queue,
+					"reply_to", meta.ReplyTo,
+					"message_id", meta.MessageID,
+					"err", err,
+				)
+			}
+			return Ack
+		},
+		opts...,
+	)
+}
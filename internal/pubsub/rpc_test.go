@@ -0,0 +1,154 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func newTestRPCClient(t *testing.T, b *MemoryBroker) *RPCClient {
+	t.Helper()
+	c, err := NewRPCClient(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func serveJoins(t *testing.T, b *MemoryBroker, handler func(routing.JoinRequest, Metadata) (routing.JoinResponse, error)) {
+	t.Helper()
+	_, err := Serve(context.Background(), b, routing.ExchangePerilDirect, "lobby", routing.JoinKey, SimpleQueueDurable, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCall(t *testing.T) {
+	b := newTestBroker(t)
+	serveJoins(t, b, func(req routing.JoinRequest, _ Metadata) (routing.JoinResponse, error) {
+		if req.Username == "" {
+			return routing.JoinResponse{}, errors.New("username can't be empty")
+		}
+		return routing.JoinResponse{Players: []string{req.Username}}, nil
+	})
+	c := newTestRPCClient(t, b)
+
+	resp, err := Call[routing.JoinRequest, routing.JoinResponse](context.Background(), c, routing.ExchangePerilDirect, routing.JoinKey, routing.JoinRequest{Username: "washington"}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Players) != 1 || resp.Players[0] != "washington" {
+		t.Fatalf("reply = %+v", resp)
+	}
+
+	_, err = Call[routing.JoinRequest, routing.JoinResponse](context.Background(), c, routing.ExchangePerilDirect, routing.JoinKey, routing.JoinRequest{}, time.Second)
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Message != "username can't be empty" {
+		t.Fatalf("err = %v, want the handler's error", err)
+	}
+}
+
+func TestCallReplyQueueUnbound(t *testing.T) {
+	b := newTestBroker(t)
+	c := newTestRPCClient(t, b)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.queues[c.replyTo]; !ok {
+		t.Fatal("reply queue wasn't declared")
+	}
+	for name, ex := range b.exchanges {
+		for _, binding := range ex.bindings {
+			if binding.queue == c.replyTo {
+				t.Errorf("reply queue bound to %s with key %s", name, binding.key)
+			}
+		}
+	}
+}
+
+func TestCallUnroutable(t *testing.T) {
+	b := newTestBroker(t)
+	c := newTestRPCClient(t, b)
+
+	start := time.Now()
+	_, err := Call[routing.JoinRequest, routing.JoinResponse](context.Background(), c, routing.ExchangePerilDirect, routing.JoinKey, routing.JoinRequest{Username: "washington"}, time.Second)
+	var unroutable *UnroutableError
+	if !errors.As(err, &unroutable) {
+		t.Fatalf("err = %v, want *UnroutableError", err)
+	}
+	if waited := time.Since(start); waited > 500*time.Millisecond {
+		t.Fatalf("unroutable call took %s, want it to fail straight away", waited)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	b := newTestBroker(t)
+	release := make(chan struct{})
+	defer close(release)
+	serveJoins(t, b, func(routing.JoinRequest, Metadata) (routing.JoinResponse, error) {
+		<-release
+		return routing.JoinResponse{}, nil
+	})
+	c := newTestRPCClient(t, b)
+
+	_, err := Call[routing.JoinRequest, routing.JoinResponse](context.Background(), c, routing.ExchangePerilDirect, routing.JoinKey, routing.JoinRequest{Username: "washington"}, 20*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want a timeout", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) != 0 {
+		t.Fatalf("%d calls still waiting for a reply", len(c.pending))
+	}
+}
+
+// lockedBuffer is a bytes.Buffer a logger can write to while a test reads.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServeLogsErrorWithoutReplyTo(t *testing.T) {
+	var logs lockedBuffer
+	SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { SetLogger(nil) })
+
+	b := newTestBroker(t)
+	handled := make(chan struct{}, 1)
+	serveJoins(t, b, func(routing.JoinRequest, Metadata) (routing.JoinResponse, error) {
+		defer func() { handled <- struct{}{} }()
+		return routing.JoinResponse{}, errors.New("lobby is full")
+	})
+	if err := Publish(context.Background(), b, routing.ExchangePerilDirect, routing.JoinKey, routing.JoinRequest{Username: "washington"}); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, handled)
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if strings.Contains(logs.String(), "lobby is full") {
+			waitForQueue(t, b, "lobby", 0)
+			return
+		}
+	}
+	t.Fatalf("error wasn't logged: %q", logs.String())
+}
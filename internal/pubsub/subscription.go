@@ -0,0 +1,240 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+)
+
+// Subscription is a running consumer. Closing it stops new deliveries,
+// lets the handler finish the message it is working on, and requeues
+// everything that was delivered but not yet handled.
+type Subscription struct {
+	stop chan struct{}
+	// stopping is cancelled along with stop, for handlers to wait on
+	stopping     context.Context
+	stopHandlers context.CancelFunc
+	handled      chan struct{}
+	done         chan struct{}
+	once         sync.Once
+	err          error
+
+	// cancel stops the broker from sending more deliveries
+	cancel func() error
+	// release runs once the handler has returned and gives back anything
+	// the consumer still holds
+	release func() error
+
+	queueName string
+	broker    retryBroker
+	retry     RetryPolicy
+	metrics   *Metrics
+}
+
+// inbound pairs a delivery with the broker specific ways of settling it.
+type inbound struct {
+	Delivery
+	ack  func() error
+	nack func(requeue bool) error
+}
+
+func newSubscription(queueName string, broker retryBroker, metrics *Metrics, cancel, release func() error) *Subscription {
+	stopping, stopHandlers := context.WithCancel(context.Background())
+	return &Subscription{
+		stop:         make(chan struct{}),
+		stopping:     stopping,
+		stopHandlers: stopHandlers,
+		handled:      make(chan struct{}),
+		done:         make(chan struct{}),
+		cancel:       cancel,
+		release:      release,
+		queueName:    queueName,
+		broker:       broker,
+		metrics:      metrics,
+	}
+}
+
+// start runs o.workers handlers over deliveries until the subscription is
+// closed, which also happens when ctx is cancelled.
+func (s *Subscription) start(ctx context.Context, deliveries <-chan inbound, handler func(Delivery) AckType, o subscribeOptions) {
+	s.retry = o.retry
+	handler = chain(handler, append([]Middleware{s.metrics.instrument(s.queueName)}, o.middleware...))
+
+	var workers sync.WaitGroup
+	if o.orderingKey == nil {
+		for i := 0; i < o.workers; i++ {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				s.handleDeliveries(deliveries, handler)
+			}()
+		}
+	} else {
+		// The broker never has more than the prefetch count outstanding, so
+		// lanes that size keep one busy key from holding up the others.
+		laneSize := o.prefetchCount
+		if laneSize <= 0 {
+			laneSize = defaultPrefetchCount
+		}
+		lanes := make([]chan inbound, o.workers)
+		for i := range lanes {
+			lanes[i] = make(chan inbound, laneSize)
+			workers.Add(1)
+			go func(lane <-chan inbound) {
+				defer workers.Done()
+				s.handleLane(lane, handler)
+			}(lanes[i])
+		}
+		go dispatchByKey(deliveries, lanes, s.stop, o.orderingKey)
+	}
+
+	go func() {
+		workers.Wait()
+		close(s.handled)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.done:
+		}
+	}()
+}
+
+func (s *Subscription) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+		s.stopHandlers()
+		cancelErr := s.cancel()
+		<-s.handled
+		s.err = errors.Join(cancelErr, s.release())
+		close(s.done)
+	})
+	<-s.done
+	return s.err
+}
+
+// Wait blocks until the subscription has been closed and fully drained.
+func (s *Subscription) Wait() {
+	<-s.done
+}
+
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Subscription) handleDeliveries(deliveries <-chan inbound, handler func(Delivery) AckType) {
+	for {
+		select {
+		case <-s.stop:
+			requeueRemaining(deliveries)
+			return
+		case msg, ok := <-deliveries:
+			if !ok {
+				return
+			}
+			// Don't start on a new message once we've been asked to stop
+			select {
+			case <-s.stop:
+				requeue(msg)
+				requeueRemaining(deliveries)
+				return
+			default:
+			}
+			s.settle(msg, s.handle(msg, handler))
+		}
+	}
+}
+
+// dispatchByKey sends deliveries with the same key to the same lane.
+func dispatchByKey(deliveries <-chan inbound, lanes []chan inbound, stop <-chan struct{}, key func(Delivery) string) {
+	defer func() {
+		for _, lane := range lanes {
+			close(lane)
+		}
+	}()
+
+	for {
+		select {
+		case <-stop:
+			requeueRemaining(deliveries)
+			return
+		case msg, ok := <-deliveries:
+			if !ok {
+				return
+			}
+			h := fnv.New32a()
+			h.Write([]byte(key(msg.Delivery)))
+			lane := lanes[h.Sum32()%uint32(len(lanes))]
+			select {
+			case lane <- msg:
+			case <-stop:
+				requeue(msg)
+				requeueRemaining(deliveries)
+				return
+			}
+		}
+	}
+}
+
+// handleLane works through one lane until dispatchByKey closes it,
+// requeueing instead of handling once the subscription is stopping.
+func (s *Subscription) handleLane(lane <-chan inbound, handler func(Delivery) AckType) {
+	for msg := range lane {
+		select {
+		case <-s.stop:
+			requeue(msg)
+			continue
+		default:
+		}
+		s.settle(msg, s.handle(msg, handler))
+	}
+}
+
+func (s *Subscription) handle(msg inbound, handler func(Delivery) AckType) AckType {
+	d := msg.Delivery
+	d.ctx = s.stopping
+	return handler(d)
+}
+
+func (s *Subscription) settle(msg inbound, ackType AckType) {
+	if ackType.kind == ackKindRetry {
+		ackType = s.scheduleRetry(msg.Delivery, ackType.delay)
+	}
+
+	switch ackType {
+	case Ack:
+		if err := msg.ack(); err != nil {
+			logger().Error("couldn't acknowledge message", append(msg.logAttrs(), "err", err)...)
+		}
+	case NackRequeue:
+		if err := msg.nack(true); err != nil {
+			logger().Error("couldn't nack message", append(msg.logAttrs(), "err", err)...)
+		}
+	case NackDiscard:
+		if err := msg.nack(false); err != nil {
+			logger().Error("couldn't discard message", append(msg.logAttrs(), "err", err)...)
+		}
+	}
+}
+
+func requeueRemaining(deliveries <-chan inbound) {
+	for {
+		select {
+		case msg, ok := <-deliveries:
+			if !ok {
+				return
+			}
+			requeue(msg)
+		default:
+			return
+		}
+	}
+}
+
+func requeue(msg inbound) {
+	if err := msg.nack(true); err != nil {
+		logger().Error("couldn't requeue message", append(msg.logAttrs(), "err", err)...)
+	}
+}
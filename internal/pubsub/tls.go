@@ -0,0 +1,77 @@
+package pubsub
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLSOptions describes how to secure an amqps:// connection. Empty fields
+// fall back to the system roots, no client certificate and the host in the
+// URL.
+type TLSOptions struct {
+	// CAFile is a PEM bundle of the certificate authorities to trust
+	CAFile string `json:"ca_file" yaml:"ca_file"`
+	// CertFile and KeyFile are the PEM client certificate and its key, for
+	// brokers that verify peers or authenticate with EXTERNAL
+	CertFile string `json:"cert_file" yaml:"cert_file"`
+	KeyFile  string `json:"key_file" yaml:"key_file"`
+	// ServerName is checked against the broker's certificate instead of the
+	// host in the URL, e.g. when connecting by IP address
+	ServerName string `json:"server_name" yaml:"server_name"`
+}
+
+// Config loads the files o names into a tls.Config.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, errors.New("client certificate and key must be given together")
+	}
+
+	config := &tls.Config{
+		ServerName: o.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read CA bundle: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", o.CAFile)
+		}
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Credentials log in with SASL PLAIN in place of the user and password in
+// the URL.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// LoadCredentials reads "username:password" from the first line of path, so
+// the password needn't appear in a URL, flag or environment variable.
+func LoadCredentials(path string) (Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("couldn't read credentials file: %w", err)
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	username, password, ok := strings.Cut(strings.TrimRight(line, "\r"), ":")
+	if !ok || username == "" {
+		return Credentials{}, fmt.Errorf("credentials file %s must contain username:password", path)
+	}
+	return Credentials{Username: username, Password: password}, nil
+}
@@ -11,3 +11,33 @@ type GameLog struct {
 	Message     string
 	Username    string
 }
+
+type JoinRequest struct {
+	Username string
+}
+
+type JoinResponse struct {
+	// Players are everyone who joined before, including this player if
+	// they are rejoining
+	Players  []string
+	IsPaused bool
+}
+
+type WhoRequest struct{}
+
+type WhoResponse struct {
+	Players []string
+}
+
+type SpawnRequest struct {
+	Username string
+	Location string
+	Rank     string
+}
+
+type SpawnResponse struct{}
+
+// LeaveRequest takes a player out of the lobby. It needs no reply.
+type LeaveRequest struct {
+	Username string
+}
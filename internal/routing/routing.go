@@ -8,8 +8,28 @@ const (
 	PauseKey = "pause"
 
 	GameLogSlug = "game_logs"
+
+	DeadLetterQueue = "peril_dlq"
+)
+
+// PausePriority is the maximum priority of the lobby queue, and the
+// priority pause and resume are published with, so they overtake requests
+// waiting there. Players' pause queues carry nothing else, and are consumed
+// apart from their moves, so they need no priority.
+const PausePriority = 10
+
+// Request/reply keys on ExchangePerilDirect
+const (
+	JoinKey  = "rpc.join"
+	WhoKey   = "rpc.who"
+	SpawnKey = "rpc.spawn"
+	LeaveKey = "rpc.leave"
 )
 
+// LobbyQueue is where servers take requests and pause from. Only one
+// server at a time consumes it, so every answer comes from the same lobby.
+const LobbyQueue = "lobby"
+
 const (
 	ExchangePerilDirect     = "peril_direct"
 	ExchangePerilTopic      = "peril_topic"
@@ -0,0 +1,75 @@
+package topology
+
+import (
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// PerilOptions names the exchanges and dead letter queue for PerilWith.
+// The exchanges have to match what the clients are configured with.
+type PerilOptions struct {
+	DirectExchange     string
+	TopicExchange      string
+	DeadLetterExchange string
+	DeadLetterQueue    string
+}
+
+func DefaultPerilOptions() PerilOptions {
+	return PerilOptions{
+		DirectExchange:     routing.ExchangePerilDirect,
+		TopicExchange:      routing.ExchangePerilTopic,
+		DeadLetterExchange: routing.ExchangePerilDeadLetter,
+		DeadLetterQueue:    routing.DeadLetterQueue,
+	}
+}
+
+// Peril is the topology the server declares on startup. Per-player queues
+// are left out: clients declare those themselves when they join.
+func Peril() Topology {
+	return PerilWith(DefaultPerilOptions())
+}
+
+// PerilWith is Peril with the names in o. The shared queues are always
+// durable, since every server and client uses them.
+func PerilWith(o PerilOptions) Topology {
+	return Topology{
+		Exchanges: []Exchange{
+			{Name: o.DirectExchange, Kind: pubsub.ExchangeKindDirect},
+			{Name: o.TopicExchange, Kind: pubsub.ExchangeKindTopic},
+			{Name: o.DeadLetterExchange, Kind: pubsub.ExchangeKindFanout},
+		},
+		Queues: []Queue{
+			{
+				Name:               routing.GameLogSlug,
+				Durable:            true,
+				DeadLetterExchange: o.DeadLetterExchange,
+			},
+			{
+				Name:               routing.WarRecognitionsPrefix,
+				Durable:            true,
+				DeadLetterExchange: o.DeadLetterExchange,
+			},
+			{
+				Name:    o.DeadLetterQueue,
+				Durable: true,
+			},
+		},
+		Bindings: []Binding{
+			{
+				Exchange: o.TopicExchange,
+				Queue:    routing.GameLogSlug,
+				Key:      routing.GameLogSlug + ".*",
+			},
+			{
+				Exchange: o.TopicExchange,
+				Queue:    routing.WarRecognitionsPrefix,
+				Key:      routing.WarRecognitionsPrefix + ".*",
+			},
+			{
+				Exchange: o.DeadLetterExchange,
+				Queue:    o.DeadLetterQueue,
+				Key:      "",
+			},
+		},
+	}
+}
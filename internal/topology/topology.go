@@ -0,0 +1,196 @@
+package topology
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"gopkg.in/yaml.v3"
+)
+
+// Topology describes the exchanges, queues and bindings the game expects
+// to find on the broker.
+type Topology struct {
+	Exchanges []Exchange `json:"exchanges" yaml:"exchanges"`
+	Queues    []Queue    `json:"queues" yaml:"queues"`
+	Bindings  []Binding  `json:"bindings" yaml:"bindings"`
+}
+
+type Exchange struct {
+	Name string              `json:"name" yaml:"name"`
+	Kind pubsub.ExchangeKind `json:"kind" yaml:"kind"`
+}
+
+type Queue struct {
+	Name                 string         `json:"name" yaml:"name"`
+	Durable              bool           `json:"durable" yaml:"durable"`
+	DeadLetterExchange   string         `json:"dead_letter_exchange,omitempty" yaml:"dead_letter_exchange,omitempty"`
+	DeadLetterRoutingKey string         `json:"dead_letter_routing_key,omitempty" yaml:"dead_letter_routing_key,omitempty"`
+	Args                 map[string]any `json:"args,omitempty" yaml:"args,omitempty"`
+}
+
+type Binding struct {
+	Exchange string `json:"exchange" yaml:"exchange"`
+	Queue    string `json:"queue" yaml:"queue"`
+	Key      string `json:"key" yaml:"key"`
+}
+
+// Drift is one way the broker differs from the topology.
+type Drift struct {
+	Kind    string
+	Name    string
+	Problem string
+}
+
+func (d Drift) String() string {
+	return fmt.Sprintf("%s %s: %s", d.Kind, d.Name, d.Problem)
+}
+
+type Report struct {
+	Drift []Drift
+	// Unverified lists what the broker had no way of checking
+	Unverified []string
+}
+
+// Load reads a topology from a .json, .yaml or .yml file.
+func Load(path string) (Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Topology{}, fmt.Errorf("couldn't read topology file: %w", err)
+	}
+
+	var t Topology
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &t)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &t)
+	default:
+		return Topology{}, fmt.Errorf("unsupported topology file type: %s", path)
+	}
+	if err != nil {
+		return Topology{}, fmt.Errorf("couldn't parse topology file: %w", err)
+	}
+
+	// JSON numbers decode as float64, but RabbitMQ wants integer arguments
+	for i := range t.Queues {
+		for k, v := range t.Queues[i].Args {
+			if f, ok := v.(float64); ok && f == math.Trunc(f) {
+				t.Queues[i].Args[k] = int64(f)
+			}
+		}
+	}
+	return t, t.Validate()
+}
+
+func (t Topology) Validate() error {
+	exchanges := map[string]struct{}{}
+	for _, ex := range t.Exchanges {
+		if ex.Name == "" {
+			return errors.New("exchange without a name")
+		}
+		switch ex.Kind {
+		case pubsub.ExchangeKindDirect, pubsub.ExchangeKindTopic, pubsub.ExchangeKindFanout:
+		default:
+			return fmt.Errorf("exchange %s has unknown kind %q", ex.Name, ex.Kind)
+		}
+		exchanges[ex.Name] = struct{}{}
+	}
+
+	queues := map[string]struct{}{}
+	for _, q := range t.Queues {
+		if q.Name == "" {
+			return errors.New("queue without a name")
+		}
+		if q.DeadLetterExchange != "" {
+			if _, ok := exchanges[q.DeadLetterExchange]; !ok {
+				return fmt.Errorf("queue %s dead-letters to undeclared exchange %s", q.Name, q.DeadLetterExchange)
+			}
+		}
+		queues[q.Name] = struct{}{}
+	}
+
+	for _, b := range t.Bindings {
+		if _, ok := exchanges[b.Exchange]; !ok {
+			return fmt.Errorf("binding of %s refers to undeclared exchange %s", b.Queue, b.Exchange)
+		}
+		if _, ok := queues[b.Queue]; !ok {
+			return fmt.Errorf("binding to %s refers to undeclared queue %s", b.Exchange, b.Queue)
+		}
+	}
+	return nil
+}
+
+// Apply declares everything in the topology. It is safe to run on every
+// startup; it fails if something already exists with other properties.
+func (t Topology) Apply(d pubsub.Declarer) error {
+	for _, ex := range t.Exchanges {
+		if err := d.DeclareExchange(ex.Name, ex.Kind); err != nil {
+			return fmt.Errorf("couldn't declare exchange %s: %w", ex.Name, err)
+		}
+	}
+	for _, q := range t.Queues {
+		if err := d.DeclareQueueWithOptions(q.Name, q.options(), q.Args); err != nil {
+			return fmt.Errorf("couldn't declare queue %s: %w", q.Name, err)
+		}
+	}
+	for _, b := range t.Bindings {
+		if err := d.BindQueue(b.Queue, b.Key, b.Exchange); err != nil {
+			return fmt.Errorf("couldn't bind %s to %s: %w", b.Queue, b.Exchange, err)
+		}
+	}
+	return nil
+}
+
+// Verify compares the topology with the broker without changing anything.
+// The error is only for failures to ask the broker at all.
+func (t Topology) Verify(v pubsub.Verifier) (Report, error) {
+	var report Report
+	check := func(kind, name string, err error) error {
+		switch {
+		case err == nil:
+		case errors.Is(err, pubsub.ErrNotFound):
+			report.Drift = append(report.Drift, Drift{Kind: kind, Name: name, Problem: "missing"})
+		case errors.Is(err, pubsub.ErrInequivalent):
+			report.Drift = append(report.Drift, Drift{Kind: kind, Name: name, Problem: "exists with different properties"})
+		case errors.Is(err, pubsub.ErrCannotVerify):
+			report.Unverified = append(report.Unverified, kind+" "+name)
+		default:
+			return fmt.Errorf("couldn't verify %s %s: %w", kind, name, err)
+		}
+		return nil
+	}
+
+	for _, ex := range t.Exchanges {
+		if err := check("exchange", ex.Name, v.VerifyExchange(ex.Name, ex.Kind)); err != nil {
+			return report, err
+		}
+	}
+	for _, q := range t.Queues {
+		if err := check("queue", q.Name, v.VerifyQueueWithOptions(q.Name, q.options(), q.Args)); err != nil {
+			return report, err
+		}
+	}
+	for _, b := range t.Bindings {
+		name := fmt.Sprintf("%s -> %s (%s)", b.Exchange, b.Queue, b.Key)
+		if err := check("binding", name, v.VerifyBinding(b.Queue, b.Key, b.Exchange)); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// options declares the queue for every server and client to share: a
+// queue that isn't durable is still neither exclusive nor auto-deleted.
+func (q Queue) options() pubsub.QueueOptions {
+	return pubsub.QueueOptions{
+		Durable:              q.Durable,
+		DeadLetterExchange:   q.DeadLetterExchange,
+		DeadLetterRoutingKey: q.DeadLetterRoutingKey,
+	}
+}
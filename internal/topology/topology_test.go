@@ -0,0 +1,168 @@
+package topology
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func newBroker(t *testing.T) *pubsub.MemoryBroker {
+	t.Helper()
+	b := pubsub.NewMemoryBroker()
+	b.SetMetrics(nil)
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func TestApplyPeril(t *testing.T) {
+	b := newBroker(t)
+	if err := Peril().Apply(b); err != nil {
+		t.Fatal(err)
+	}
+
+	shared := pubsub.QueueOptions{Durable: true, DeadLetterExchange: routing.ExchangePerilDeadLetter}
+	for _, name := range []string{routing.GameLogSlug, routing.WarRecognitionsPrefix} {
+		if err := b.VerifyQueueWithOptions(name, shared, nil); err != nil {
+			t.Errorf("queue %s: %v", name, err)
+		}
+	}
+	if err := b.VerifyQueueWithOptions(routing.DeadLetterQueue, pubsub.QueueOptions{Durable: true}, nil); err != nil {
+		t.Errorf("queue %s: %v", routing.DeadLetterQueue, err)
+	}
+
+	// Applying again on every startup is fine
+	if err := Peril().Apply(b); err != nil {
+		t.Fatalf("couldn't apply twice: %v", err)
+	}
+}
+
+func TestApplyNonDurableQueueIsShared(t *testing.T) {
+	b := newBroker(t)
+	topo := Topology{
+		Exchanges: []Exchange{{Name: "ex", Kind: pubsub.ExchangeKindDirect}},
+		Queues:    []Queue{{Name: "scratch", Args: map[string]any{"x-max-length": int64(10)}}},
+		Bindings:  []Binding{{Exchange: "ex", Queue: "scratch", Key: "scratch"}},
+	}
+	if err := topo.Apply(b); err != nil {
+		t.Fatal(err)
+	}
+
+	args := map[string]any{"x-max-length": int64(10)}
+	if err := b.VerifyQueueWithOptions("scratch", pubsub.QueueOptions{}, args); err != nil {
+		t.Fatalf("queue isn't a plain non-durable queue: %v", err)
+	}
+	if err := b.VerifyQueue("scratch", pubsub.SimpleQueueTransient, args); !errors.Is(err, pubsub.ErrInequivalent) {
+		t.Fatalf("queue was declared exclusive: %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	b := newBroker(t)
+	if err := Peril().Apply(b); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Peril().Verify(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Drift) != 0 || len(report.Unverified) != 0 {
+		t.Fatalf("report after Apply = %+v, want nothing", report)
+	}
+
+	want := Topology{
+		Exchanges: []Exchange{
+			{Name: routing.ExchangePerilTopic, Kind: pubsub.ExchangeKindTopic},
+			{Name: "missing_exchange", Kind: pubsub.ExchangeKindDirect},
+		},
+		Queues: []Queue{
+			{Name: routing.GameLogSlug, Durable: true},
+			{Name: "missing_queue", Durable: true},
+		},
+		Bindings: []Binding{
+			{Exchange: routing.ExchangePerilTopic, Queue: routing.GameLogSlug, Key: "other.*"},
+		},
+	}
+	report, err = want.Verify(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDrift := []Drift{
+		{Kind: "exchange", Name: "missing_exchange", Problem: "missing"},
+		{Kind: "queue", Name: routing.GameLogSlug, Problem: "exists with different properties"},
+		{Kind: "queue", Name: "missing_queue", Problem: "missing"},
+		{Kind: "binding", Name: routing.ExchangePerilTopic + " -> " + routing.GameLogSlug + " (other.*)", Problem: "missing"},
+	}
+	if !reflect.DeepEqual(report.Drift, wantDrift) {
+		t.Fatalf("drift = %v, want %v", report.Drift, wantDrift)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	files := map[string]string{
+		"topology.json": `{
+			"exchanges": [{"name": "ex", "kind": "direct"}, {"name": "dlx", "kind": "fanout"}],
+			"queues": [{"name": "q", "durable": true, "dead_letter_exchange": "dlx", "args": {"x-max-length": 10}}],
+			"bindings": [{"exchange": "ex", "queue": "q", "key": "q"}]
+		}`,
+		"topology.yaml": `
+exchanges:
+  - {name: ex, kind: direct}
+  - {name: dlx, kind: fanout}
+queues:
+  - {name: q, durable: true, dead_letter_exchange: dlx, args: {x-max-length: 10}}
+bindings:
+  - {exchange: ex, queue: q, key: q}
+`,
+	}
+	for name, data := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			topo, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(topo.Queues) != 1 || topo.Queues[0].DeadLetterExchange != "dlx" {
+				t.Fatalf("queues = %+v", topo.Queues)
+			}
+			if n, ok := topo.Queues[0].Args["x-max-length"]; !ok || n != int64(10) && n != 10 {
+				t.Fatalf("x-max-length = %#v, want an integer 10", n)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := map[string]Topology{
+		"unknown kind": {Exchanges: []Exchange{{Name: "ex", Kind: "headers"}}},
+		"undeclared dead letter exchange": {
+			Queues: []Queue{{Name: "q", DeadLetterExchange: "dlx"}},
+		},
+		"undeclared exchange": {
+			Queues:   []Queue{{Name: "q"}},
+			Bindings: []Binding{{Exchange: "ex", Queue: "q"}},
+		},
+		"undeclared queue": {
+			Exchanges: []Exchange{{Name: "ex", Kind: pubsub.ExchangeKindDirect}},
+			Bindings:  []Binding{{Exchange: "ex", Queue: "q"}},
+		},
+	}
+	for name, topo := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := topo.Validate(); err == nil {
+				t.Fatal("validated")
+			}
+		})
+	}
+	if err := Peril().Validate(); err != nil {
+		t.Fatalf("Peril() is invalid: %v", err)
+	}
+}
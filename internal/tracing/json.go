@@ -0,0 +1,26 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// JSONExporter writes each span to w as a line of JSON.
+type JSONExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{enc: json.NewEncoder(w)}
+}
+
+func (e *JSONExporter) ExportSpan(span SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.enc.Encode(span); err != nil {
+		slog.Error("couldn't export span", "span", span.Name, "err", err)
+	}
+}
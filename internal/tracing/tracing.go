@@ -0,0 +1,226 @@
+// Package tracing carries W3C trace context through messages and records
+// spans for publishing and handling them.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceParentHeader is the W3C header that carries a SpanContext.
+const TraceParentHeader = "traceparent"
+
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// TraceParent formats sc as a version 00 traceparent header.
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceParent reads a traceparent header. Later versions are read as
+// version 00, as the spec asks.
+func ParseTraceParent(header string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q", header)
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q", header)
+	}
+
+	var sc SpanContext
+	if err := decodeHex(sc.TraceID[:], parts[1]); err != nil {
+		return SpanContext{}, fmt.Errorf("invalid trace ID in traceparent %q", header)
+	}
+	if err := decodeHex(sc.SpanID[:], parts[2]); err != nil {
+		return SpanContext{}, fmt.Errorf("invalid span ID in traceparent %q", header)
+	}
+	var flags [1]byte
+	if err := decodeHex(flags[:], parts[3]); err != nil {
+		return SpanContext{}, fmt.Errorf("invalid flags in traceparent %q", header)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q", header)
+	}
+	return sc, nil
+}
+
+func decodeHex(dst []byte, s string) error {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return fmt.Errorf("expected %d lowercase hex digits", hex.EncodedLen(len(dst)))
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+// SpanData is a finished span as handed to an Exporter.
+type SpanData struct {
+	Name       string         `json:"name"`
+	TraceID    string         `json:"trace_id"`
+	SpanID     string         `json:"span_id"`
+	ParentID   string         `json:"parent_id,omitempty"`
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+type Exporter interface {
+	ExportSpan(SpanData)
+}
+
+var (
+	exporterMu sync.RWMutex
+	exporter   Exporter
+)
+
+// SetExporter sends every span finished from now on to e. Without an
+// exporter spans are still created, so trace context keeps propagating, but
+// they are dropped when they end.
+func SetExporter(e Exporter) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+	exporter = e
+}
+
+func currentExporter() Exporter {
+	exporterMu.RLock()
+	defer exporterMu.RUnlock()
+	return exporter
+}
+
+type Span struct {
+	sc SpanContext
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+type spanKey struct{}
+
+// Start begins a span that is a child of parent, or of the span in ctx if
+// parent isn't valid, or the root of a new trace if neither is. The returned
+// context carries the new span.
+func Start(ctx context.Context, parent SpanContext, name string) (context.Context, *Span) {
+	if !parent.IsValid() {
+		parent = SpanFromContext(ctx).SpanContext()
+	}
+
+	sc := SpanContext{TraceID: parent.TraceID, Sampled: true}
+	if parent.IsValid() {
+		sc.Sampled = parent.Sampled
+	} else {
+		rand.Read(sc.TraceID[:])
+	}
+	rand.Read(sc.SpanID[:])
+
+	span := &Span{
+		sc: sc,
+		data: SpanData{
+			Name:    name,
+			TraceID: sc.TraceID.String(),
+			SpanID:  sc.SpanID.String(),
+			Start:   time.Now(),
+		},
+	}
+	if parent.IsValid() {
+		span.data.ParentID = parent.SpanID.String()
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SpanFromContext returns the span in ctx, or nil. Span methods are safe to
+// call on nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = map[string]any{}
+	}
+	s.data.Attributes[key] = value
+}
+
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = err.Error()
+}
+
+// End finishes the span and exports it if it was sampled. Only the first
+// call counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if e := currentExporter(); e != nil && s.sc.Sampled {
+		e.ExportSpan(data)
+	}
+}
@@ -0,0 +1,146 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+)
+
+type recorder struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (r *recorder) ExportSpan(span SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func record(t *testing.T) *recorder {
+	t.Helper()
+	r := &recorder{}
+	SetExporter(r)
+	t.Cleanup(func() { SetExporter(nil) })
+	return r
+}
+
+func TestParseTraceParent(t *testing.T) {
+	const header = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceParent(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Fatalf("parsed %+v", sc)
+	}
+	if got := sc.TraceParent(); got != header {
+		t.Fatalf("TraceParent() = %s, want %s", got, header)
+	}
+
+	// A later version may add fields
+	if _, err := ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra"); err != nil {
+		t.Fatalf("couldn't parse a later version: %v", err)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz",
+	} {
+		if sc, err := ParseTraceParent(invalid); err == nil {
+			t.Errorf("parsed %q as %+v", invalid, sc)
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	r := record(t)
+
+	ctx, root := Start(context.Background(), SpanContext{}, "root")
+	if !root.SpanContext().IsValid() || !root.SpanContext().Sampled {
+		t.Fatalf("root span context = %+v", root.SpanContext())
+	}
+	_, child := Start(ctx, SpanContext{}, "child")
+	if child.SpanContext().TraceID != root.SpanContext().TraceID {
+		t.Fatal("child started a new trace")
+	}
+	child.SetAttribute("key", "value")
+	child.RecordError(errors.New("failed"))
+	child.End()
+	child.End()
+	root.End()
+
+	if len(r.spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(r.spans))
+	}
+	got := r.spans[0]
+	if got.Name != "child" || got.ParentID != root.SpanContext().SpanID.String() {
+		t.Fatalf("child exported as %+v", got)
+	}
+	if got.Attributes["key"] != "value" || got.Error != "failed" {
+		t.Fatalf("child exported with attributes %v and error %q", got.Attributes, got.Error)
+	}
+	if r.spans[1].ParentID != "" {
+		t.Fatalf("root exported with parent %s", r.spans[1].ParentID)
+	}
+}
+
+func TestStartFromRemoteParent(t *testing.T) {
+	r := record(t)
+	parent, err := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The remote parent wins over the span in ctx
+	ctx, local := Start(context.Background(), SpanContext{}, "local")
+	defer local.End()
+	_, span := Start(ctx, parent, "remote child")
+	if span.SpanContext().TraceID != parent.TraceID || span.SpanContext().Sampled {
+		t.Fatalf("span context = %+v, want an unsampled span in %s", span.SpanContext(), parent.TraceID)
+	}
+	span.End()
+	if len(r.spans) != 0 {
+		t.Fatalf("exported %d unsampled spans", len(r.spans))
+	}
+}
+
+func TestNilSpan(t *testing.T) {
+	span := SpanFromContext(context.Background())
+	if span != nil {
+		t.Fatal("found a span in an empty context")
+	}
+	span.SetAttribute("key", "value")
+	span.RecordError(errors.New("failed"))
+	span.End()
+	if span.SpanContext().IsValid() {
+		t.Fatal("nil span has a valid span context")
+	}
+}
+
+func TestJSONExporter(t *testing.T) {
+	var buf bytes.Buffer
+	SetExporter(NewJSONExporter(&buf))
+	t.Cleanup(func() { SetExporter(nil) })
+
+	_, span := Start(context.Background(), SpanContext{}, "publish")
+	span.SetAttribute("messaging.destination", "peril_topic")
+	span.End()
+
+	var got SpanData
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("couldn't read exported span %q: %v", buf.String(), err)
+	}
+	if got.Name != "publish" || got.SpanID != span.SpanContext().SpanID.String() || got.Attributes["messaging.destination"] != "peril_topic" {
+		t.Fatalf("exported %+v", got)
+	}
+}
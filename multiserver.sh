@@ -2,11 +2,12 @@
 
 # Check if the number of instances was provided
 if [ -z "$1" ]; then
-  echo "Usage: $0 <number-of-instances>"
+  echo "Usage: $0 <number-of-instances> [server flags...]"
   exit 1
 fi
 
 num_instances=$1
+shift
 
 # Array to store process IDs
 declare -a pids
@@ -25,7 +26,7 @@ trap 'cleanup' SIGINT
 
 # Start the specified number of instances of the program in the background
 for (( i=0; i<num_instances; i++ )); do
-  go run ./cmd/server &
+  go run ./cmd/server "$@" &
   pids+=($!)
 done
 